@@ -1,16 +1,36 @@
 module github.com/starkandwayne/vault-concourse-resource
 
-go 1.15
+go 1.22.0
 
 require (
+	filippo.io/age v1.2.1
+	github.com/ProtonMail/go-crypto v1.3.0
 	github.com/aws/aws-sdk-go v1.35.5
 	github.com/cloudboss/ofcourse v0.2.2
 	github.com/cloudfoundry-community/vaultkv v0.1.1
-	github.com/maxbrunsfeld/counterfeiter/v6 v6.2.3 // indirect
 	github.com/mitchellh/mapstructure v1.4.0
 	github.com/onsi/ginkgo v1.14.1
 	github.com/onsi/gomega v1.10.2
 	github.com/starkandwayne/safe v1.5.8
-	github.com/stretchr/testify v1.6.1
 	gopkg.in/yaml.v2 v2.3.0
 )
+
+require (
+	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5 // indirect
+	github.com/cloudflare/circl v1.6.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/jhunt/go-ansi v0.0.0-20180630013815-403d5f0d9ccb // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/mattn/go-isatty v0.0.0-20151211000621-56b76bdf51f7 // indirect
+	github.com/nxadm/tail v1.4.4 // indirect
+	github.com/starkandwayne/goutils v0.0.0-20170530161610-d28cacc19462 // indirect
+	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/tredoe/osutil v0.0.0-20161130133508-7d3ee1afa71c // indirect
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/term v0.29.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+)
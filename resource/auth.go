@@ -0,0 +1,248 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// AuthKubernetes logs in with the worker's Kubernetes service account token.
+	AuthKubernetes = "kubernetes"
+	// AuthAWSIAM logs in with a signed sts:GetCallerIdentity request made using
+	// the worker's AWS credentials.
+	AuthAWSIAM = "aws_iam"
+	// AuthJWT logs in with a JWT such as a Concourse identity token.
+	AuthJWT = "jwt"
+	// AuthCert logs in with the client certificate presented for mutual TLS.
+	AuthCert = "cert"
+
+	defaultApproleMount      = "approle"
+	defaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// defaultAuthMounts are the paths each auth method is mounted at unless the
+// auth block names another mount.
+var defaultAuthMounts = map[string]string{
+	AuthKubernetes: "kubernetes",
+	AuthAWSIAM:     "aws",
+	AuthJWT:        "jwt",
+	AuthCert:       "cert",
+}
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+type apiErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// login authenticates against the auth method configured in the source's
+// auth block and sets the resulting token on the client.
+func (r *Resource) login(a Auth) error {
+	switch a.Method {
+	case AuthKubernetes:
+		return r.loginKubernetes(a)
+	case AuthAWSIAM:
+		return r.loginAWSIAM(a)
+	case AuthJWT:
+		return r.loginJWT(a)
+	case AuthCert:
+		return r.loginCert(a)
+	}
+	return fmt.Errorf("Unsupported auth method `%s'", a.Method)
+}
+
+func (r *Resource) loginAppRole(s Source) error {
+	return r.authLogin(s.ApproleMount, map[string]string{
+		"role_id":   s.RoleID,
+		"secret_id": s.SecretID,
+	})
+}
+
+// unwrapSecretID exchanges a response-wrapping token for the secret_id it
+// wraps. Wrapping tokens are single use, so every step needs a fresh one. A
+// token that is looked up fine but then cannot be unwrapped, or that was not
+// created by a secret-id endpoint of the AppRole mount, means someone else may
+// have seen the secret_id.
+func (r *Resource) unwrapSecretID(wrappingToken, mount string) (string, error) {
+	var lookup struct {
+		Data struct {
+			CreationPath string `json:"creation_path"`
+		} `json:"data"`
+	}
+	err := r.post("sys/wrapping/lookup", map[string]string{"token": wrappingToken}, &lookup)
+	if err != nil {
+		return "", fmt.Errorf("The secret_id wrapping token is invalid, expired or was already used; "+
+			"secret_id_wrapped needs a fresh wrapping token for every step: %s", err)
+	}
+	rolePrefix := fmt.Sprintf("auth/%s/role/", strings.Trim(mount, "/"))
+	if !strings.HasPrefix(lookup.Data.CreationPath, rolePrefix) ||
+		!strings.HasSuffix(lookup.Data.CreationPath, "/secret-id") {
+		return "", fmt.Errorf("The secret_id wrapping token was created by `%s', not by a secret-id endpoint under `%s'",
+			lookup.Data.CreationPath, rolePrefix)
+	}
+
+	vaultClient := r.client.Client().Client
+	vaultClient.SetAuthToken(wrappingToken)
+	defer vaultClient.SetAuthToken("")
+	var unwrapped struct {
+		Data struct {
+			SecretID string `json:"secret_id"`
+		} `json:"data"`
+	}
+	err = r.post("sys/wrapping/unwrap", nil, &unwrapped)
+	if err != nil {
+		return "", fmt.Errorf("The secret_id wrapping token was unwrapped by someone else after it was looked up, "+
+			"the secret_id may have been intercepted: %s", err)
+	}
+	if unwrapped.Data.SecretID == "" {
+		return "", fmt.Errorf("No secret_id found in the wrapped response")
+	}
+	return unwrapped.Data.SecretID, nil
+}
+
+func (r *Resource) loginKubernetes(a Auth) error {
+	jwt, err := ioutil.ReadFile(a.JWTPath)
+	if err != nil {
+		return fmt.Errorf("Error reading service account token '%s': %s", a.JWTPath, err)
+	}
+	return r.authLogin(a.Mount, map[string]string{
+		"role": a.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+func (r *Resource) loginJWT(a Auth) error {
+	jwt := a.JWT
+	switch {
+	case a.JWTPath != "":
+		raw, err := ioutil.ReadFile(a.JWTPath)
+		if err != nil {
+			return fmt.Errorf("Error reading JWT '%s': %s", a.JWTPath, err)
+		}
+		jwt = string(raw)
+	case a.JWTEnv != "":
+		jwt = os.Getenv(a.JWTEnv)
+		if jwt == "" {
+			return fmt.Errorf("Environment variable %s holding the JWT is empty", a.JWTEnv)
+		}
+	}
+	payload := map[string]string{
+		"jwt": strings.TrimSpace(jwt),
+	}
+	if a.Role != "" {
+		payload["role"] = a.Role
+	}
+	return r.authLogin(a.Mount, payload)
+}
+
+// loginCert relies on configureTLS having set client_cert on the transport;
+// vault identifies the caller from the certificate presented in the handshake.
+func (r *Resource) loginCert(a Auth) error {
+	payload := map[string]string{}
+	if a.Role != "" {
+		payload["name"] = a.Role
+	}
+	return r.authLogin(a.Mount, payload)
+}
+
+func (r *Resource) loginAWSIAM(a Auth) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("Error loading AWS credentials: %s", err)
+	}
+	config := aws.NewConfig()
+	if a.Region != "" {
+		config = config.WithRegion(a.Region)
+	} else if aws.StringValue(sess.Config.Region) == "" {
+		config = config.WithRegion("us-east-1")
+	}
+	req, _ := sts.New(sess, config).GetCallerIdentityRequest(nil)
+	if a.ServerID != "" {
+		req.HTTPRequest.Header.Add("X-Vault-AWS-IAM-Server-ID", a.ServerID)
+	}
+	err = req.Sign()
+	if err != nil {
+		return fmt.Errorf("Error signing sts:GetCallerIdentity request: %s", err)
+	}
+	headers, err := json.Marshal(req.HTTPRequest.Header)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(req.HTTPRequest.Body)
+	if err != nil {
+		return err
+	}
+	return r.authLogin(a.Mount, map[string]string{
+		"role":                    a.Role,
+		"iam_http_request_method": req.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	})
+}
+
+// authLogin posts payload to auth/<mount>/login and sets the client token
+// from the response.
+func (r *Resource) authLogin(mount string, payload interface{}) error {
+	loginPath := fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/"))
+	var result authResponse
+	err := r.post(loginPath, payload, &result)
+	if err != nil {
+		return fmt.Errorf("Error logging in via %s: %s", loginPath, err)
+	}
+	if result.Auth.ClientToken == "" {
+		return fmt.Errorf("No client token returned from %s", loginPath)
+	}
+	r.client.Client().Client.SetAuthToken(result.Auth.ClientToken)
+	r.ownedToken = result.Auth.ClientToken
+	return nil
+}
+
+// post sends payload as JSON to the vault API at path and decodes a
+// successful response into result, which may be nil.
+func (r *Resource) post(path string, payload interface{}, result interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := r.client.Curl("POST", path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr apiErrors
+		json.Unmarshal(raw, &apiErr)
+		return fmt.Errorf("%s returned %d: %s", path, resp.StatusCode, strings.Join(apiErr.Errors, ", "))
+	}
+	if result != nil && len(raw) > 0 {
+		err = json.Unmarshal(raw, result)
+		if err != nil {
+			return fmt.Errorf("Error decoding response from %s: %s", path, err)
+		}
+	}
+	return nil
+}
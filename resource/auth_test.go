@@ -0,0 +1,318 @@
+package resource_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+// loginHandler mimics an auth/<mount>/login endpoint, handing out a new
+// token from the fake vault when the request body matches expected.
+func loginHandler(vault *fakeVault, expected map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&body)
+		for key, value := range expected {
+			if body[key] != value {
+				writeFakeError(w, http.StatusBadRequest, "invalid "+key)
+				return
+			}
+		}
+		writeFakeJSON(w, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   vault.IssueToken(),
+				"lease_duration": 3600,
+				"renewable":      true,
+			},
+		})
+	}
+}
+
+var _ = Describe("Auth", func() {
+	var (
+		vault      *fakeVault
+		home       string
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		var err error
+		home, err = ioutil.TempDir("", "vault-concourse-auth")
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Set("secret/handshake", map[string]string{"knock": "knock"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"paths": []string{"secret/handshake"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(home)
+	})
+
+	Describe("approle", func() {
+		BeforeEach(func() {
+			source["role_id"] = "role"
+			source["secret_id"] = "secret"
+		})
+
+		It("should log in against the default mount", func() {
+			vault.Handle("auth/approle/login", loginHandler(vault, map[string]interface{}{
+				"role_id":   "role",
+				"secret_id": "secret",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should log in against approle_mount", func() {
+			source["approle_mount"] = "ci/approle"
+			vault.Handle("auth/ci/approle/login", loginHandler(vault, map[string]interface{}{
+				"role_id":   "role",
+				"secret_id": "secret",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("when the secret_id is wrapped", func() {
+			var creationPath string
+			var unwrapped bool
+
+			BeforeEach(func() {
+				source["secret_id"] = "wrapping-token"
+				source["secret_id_wrapped"] = true
+				creationPath = "auth/approle/role/concourse/secret-id"
+				unwrapped = false
+				vault.Handle("sys/wrapping/lookup", func(w http.ResponseWriter, req *http.Request) {
+					if unwrapped {
+						writeFakeError(w, http.StatusBadRequest, "wrapping token is not valid or does not exist")
+						return
+					}
+					writeFakeJSON(w, map[string]interface{}{
+						"data": map[string]interface{}{"creation_path": creationPath},
+					})
+				})
+				vault.Handle("sys/wrapping/unwrap", func(w http.ResponseWriter, req *http.Request) {
+					if unwrapped || req.Header.Get("X-Vault-Token") != "wrapping-token" {
+						writeFakeError(w, http.StatusBadRequest, "wrapping token is not valid or does not exist")
+						return
+					}
+					unwrapped = true
+					writeFakeJSON(w, map[string]interface{}{
+						"data": map[string]interface{}{"secret_id": "unwrapped-secret"},
+					})
+				})
+				vault.Handle("auth/approle/login", loginHandler(vault, map[string]interface{}{
+					"role_id":   "role",
+					"secret_id": "unwrapped-secret",
+				}))
+			})
+
+			It("should unwrap the secret_id and log in with it", func() {
+				_, err := r.Check(source, nil, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should ask for a fresh wrapping token when one is reused", func() {
+				_, err := r.Check(source, nil, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = r.Check(source, nil, env, testLogger)
+				Expect(err).To(MatchError(ContainSubstring("fresh wrapping token for every step")))
+				Expect(err).ToNot(MatchError(ContainSubstring("intercepted")))
+			})
+
+			It("should fail loudly when the token is unwrapped between lookup and unwrap", func() {
+				vault.Handle("sys/wrapping/lookup", func(w http.ResponseWriter, req *http.Request) {
+					unwrapped = true
+					writeFakeJSON(w, map[string]interface{}{
+						"data": map[string]interface{}{"creation_path": creationPath},
+					})
+				})
+				_, err := r.Check(source, nil, env, testLogger)
+				Expect(err).To(MatchError(ContainSubstring("may have been intercepted")))
+			})
+
+			It("should refuse a wrapping token not created for a secret_id", func() {
+				creationPath = "sys/wrapping/wrap"
+				_, err := r.Check(source, nil, env, testLogger)
+				Expect(err).To(MatchError(ContainSubstring("sys/wrapping/wrap")))
+				Expect(unwrapped).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("kubernetes", func() {
+		var jwtPath string
+
+		BeforeEach(func() {
+			jwtPath = filepath.Join(home, "token")
+			Expect(ioutil.WriteFile(jwtPath, []byte("service-account-jwt\n"), 0600)).To(Succeed())
+			source["auth"] = map[string]interface{}{
+				"method":   "kubernetes",
+				"role":     "concourse",
+				"jwt_path": jwtPath,
+			}
+		})
+
+		It("should log in with the service account token", func() {
+			vault.Handle("auth/kubernetes/login", loginHandler(vault, map[string]interface{}{
+				"role": "concourse",
+				"jwt":  "service-account-jwt",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should log in against a custom mount", func() {
+			source["auth"].(map[string]interface{})["mount"] = "k8s/prod"
+			vault.Handle("auth/k8s/prod/login", loginHandler(vault, map[string]interface{}{
+				"role": "concourse",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should surface login errors", func() {
+			vault.Handle("auth/kubernetes/login", loginHandler(vault, map[string]interface{}{
+				"role": "someone-else",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(MatchError(ContainSubstring("invalid role")))
+		})
+
+		It("should require a role", func() {
+			delete(source["auth"].(map[string]interface{}), "role")
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(MatchError("Missing auth.role field"))
+		})
+	})
+
+	Describe("jwt", func() {
+		BeforeEach(func() {
+			vault.Handle("auth/jwt/login", loginHandler(vault, map[string]interface{}{
+				"role": "concourse",
+				"jwt":  "identity-token",
+			}))
+		})
+
+		It("should log in with a token read from a file", func() {
+			jwtPath := filepath.Join(home, "idtoken")
+			Expect(ioutil.WriteFile(jwtPath, []byte("identity-token"), 0600)).To(Succeed())
+			source["auth"] = map[string]interface{}{
+				"method":   "jwt",
+				"role":     "concourse",
+				"jwt_path": jwtPath,
+			}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should log in with a token read from the environment", func() {
+			os.Setenv("VAULT_CONCOURSE_TEST_JWT", "identity-token")
+			defer os.Unsetenv("VAULT_CONCOURSE_TEST_JWT")
+			source["auth"] = map[string]interface{}{
+				"method":  "jwt",
+				"role":    "concourse",
+				"jwt_env": "VAULT_CONCOURSE_TEST_JWT",
+			}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should log in against a custom mount", func() {
+			vault.Handle("auth/oidc-concourse/login", loginHandler(vault, map[string]interface{}{
+				"jwt": "identity-token",
+			}))
+			source["auth"] = map[string]interface{}{
+				"method": "jwt",
+				"mount":  "oidc-concourse",
+				"jwt":    "identity-token",
+			}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should require a token source", func() {
+			source["auth"] = map[string]interface{}{
+				"method": "jwt",
+				"role":   "concourse",
+			}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(MatchError(ContainSubstring("auth.jwt_path")))
+		})
+	})
+
+	Describe("aws_iam", func() {
+		var request map[string]interface{}
+
+		BeforeEach(func() {
+			os.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+			source["auth"] = map[string]interface{}{
+				"method":    "aws_iam",
+				"role":      "concourse",
+				"server_id": "vault.example.com",
+			}
+			request = nil
+			vault.Handle("auth/aws/login", func(w http.ResponseWriter, req *http.Request) {
+				json.NewDecoder(req.Body).Decode(&request)
+				loginHandler(vault, nil)(w, req)
+			})
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+			os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		})
+
+		decode := func(key string) string {
+			raw, err := base64.StdEncoding.DecodeString(request[key].(string))
+			Expect(err).ToNot(HaveOccurred())
+			return string(raw)
+		}
+
+		It("should log in with a signed sts:GetCallerIdentity request", func() {
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(request["role"]).To(Equal("concourse"))
+			Expect(request["iam_http_request_method"]).To(Equal("POST"))
+			Expect(decode("iam_request_url")).To(ContainSubstring("sts.amazonaws.com"))
+			Expect(decode("iam_request_body")).To(ContainSubstring("Action=GetCallerIdentity"))
+
+			headers := map[string][]string{}
+			Expect(json.Unmarshal([]byte(decode("iam_request_headers")), &headers)).To(Succeed())
+			Expect(headers["X-Vault-Aws-Iam-Server-Id"]).To(Equal([]string{"vault.example.com"}))
+			Expect(headers["Authorization"][0]).To(ContainSubstring("AKIAEXAMPLE"))
+			Expect(headers["Authorization"][0]).To(ContainSubstring("x-vault-aws-iam-server-id"))
+		})
+
+		It("should log in against a custom mount", func() {
+			source["auth"].(map[string]interface{})["mount"] = "aws-ec2-workers"
+			vault.Handle("auth/aws-ec2-workers/login", loginHandler(vault, map[string]interface{}{
+				"role": "concourse",
+			}))
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	It("should reject unknown auth methods", func() {
+		source["auth"] = map[string]interface{}{"method": "carrier-pigeon"}
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("carrier-pigeon")))
+	})
+})
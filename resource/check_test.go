@@ -0,0 +1,59 @@
+package resource_test
+
+import (
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Check", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		vault.Set("secret/handshake", map[string]string{"knock": "knock"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/handshake"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should return the current version on the first check", func() {
+		versions, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions).To(HaveLen(1))
+		Expect(versions[0]).To(HaveKey("secret_sha1"))
+		Expect(versions[0]).To(HaveKeyWithValue("url", vault.URL))
+	})
+
+	It("should return the given version when nothing changed", func() {
+		first, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		versions, err := r.Check(source, first[0], env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions).To(Equal(first))
+	})
+
+	It("should return a new version when a secret changed", func() {
+		first, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		vault.Set("secret/handshake", map[string]string{"knock": "who's there"})
+		versions, err := r.Check(source, first[0], env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions).To(HaveLen(1))
+		Expect(versions[0]).ToNot(BeEmpty())
+		Expect(versions[0]["secret_sha1"]).ToNot(Equal(first[0]["secret_sha1"]))
+	})
+})
@@ -0,0 +1,97 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const defaultTransitMount = "transit"
+
+// digester computes the digests stored in versions. Keyed digesters produce
+// `secret_hmac` versions; the unkeyed SHA1 digester produces the legacy
+// `secret_sha1` versions, which can be brute forced for low entropy secrets.
+type digester struct {
+	keyed  bool
+	digest func(inputs [][]byte) ([]string, error)
+}
+
+// versionDigester picks the digester configured by the source.
+func (r *Resource) versionDigester(s Source) digester {
+	switch {
+	case s.VersionTransitKey != "":
+		return digester{keyed: true, digest: r.transitDigests(s.VersionTransitMount, s.VersionTransitKey)}
+	case s.VersionKey != "":
+		return digester{keyed: true, digest: hmacDigests(s.VersionKey)}
+	}
+	return legacyDigester
+}
+
+var legacyDigester = digester{digest: sha1Digests}
+
+func sha1Digests(inputs [][]byte) ([]string, error) {
+	digests := make([]string, len(inputs))
+	for i, input := range inputs {
+		digests[i] = fmt.Sprintf("%x", sha1.Sum(input))
+	}
+	return digests, nil
+}
+
+func hmacDigests(key string) func([][]byte) ([]string, error) {
+	return func(inputs [][]byte) ([]string, error) {
+		digests := make([]string, len(inputs))
+		for i, input := range inputs {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(input)
+			digests[i] = hex.EncodeToString(mac.Sum(nil))
+		}
+		return digests, nil
+	}
+}
+
+// transitDigests computes HMAC-SHA256 digests with a vault transit key, so
+// the key never leaves vault. All inputs are sent in a single batch request.
+func (r *Resource) transitDigests(mount, key string) func([][]byte) ([]string, error) {
+	return func(inputs [][]byte) ([]string, error) {
+		batch := make([]map[string]string, len(inputs))
+		for i, input := range inputs {
+			batch[i] = map[string]string{"input": base64.StdEncoding.EncodeToString(input)}
+		}
+		var result struct {
+			Data struct {
+				BatchResults []struct {
+					HMAC  string `json:"hmac"`
+					Error string `json:"error"`
+				} `json:"batch_results"`
+			} `json:"data"`
+		}
+		hmacPath := fmt.Sprintf("%s/hmac/%s/sha2-256", strings.Trim(mount, "/"), key)
+		err := r.post(hmacPath, map[string]interface{}{"batch_input": batch}, &result)
+		if err != nil {
+			return nil, fmt.Errorf("Error computing version HMAC: %s", err)
+		}
+		if len(result.Data.BatchResults) != len(inputs) {
+			return nil, fmt.Errorf("Expected %d results from %s, got %d",
+				len(inputs), hmacPath, len(result.Data.BatchResults))
+		}
+		digests := make([]string, len(inputs))
+		for i, res := range result.Data.BatchResults {
+			if res.Error != "" {
+				return nil, fmt.Errorf("Error computing version HMAC: %s", res.Error)
+			}
+			// Transit HMACs look like vault:v1:<base64>
+			parts := strings.Split(res.HMAC, ":")
+			raw, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			if err != nil {
+				return nil, fmt.Errorf("Error decoding HMAC from %s: %s", hmacPath, err)
+			}
+			digests[i] = hex.EncodeToString(raw)
+		}
+		return digests, nil
+	}
+}
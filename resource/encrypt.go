@@ -0,0 +1,88 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Encrypt lists the age or GPG public keys In encrypts its files to.
+type Encrypt struct {
+	// Age holds age recipients such as "age1...".
+	Age []string `mapstructure:"age"`
+	// GPG holds ASCII armored public keys.
+	GPG []string `mapstructure:"gpg"`
+	// Tarball writes a single encrypted tarball of the files instead.
+	Tarball bool `mapstructure:"tarball"`
+}
+
+// encrypter encrypts the files In writes, which are named with its extension.
+type encrypter struct {
+	extension string
+	encrypt   func(w io.Writer) (io.WriteCloser, error)
+}
+
+func (p *InParams) parseEncryption() (err error) {
+	p.encrypter, err = p.Encrypt.encrypter()
+	return err
+}
+
+func (e Encrypt) encrypter() (*encrypter, error) {
+	switch {
+	case len(e.Age) > 0 && len(e.GPG) > 0:
+		return nil, fmt.Errorf("Only one of encrypt.age and encrypt.gpg may be set")
+	case len(e.Age) > 0:
+		return ageEncrypter(e.Age)
+	case len(e.GPG) > 0:
+		return gpgEncrypter(e.GPG)
+	case e.Tarball:
+		return nil, fmt.Errorf("encrypt.tarball requires encrypt.age or encrypt.gpg")
+	}
+	return nil, nil
+}
+
+func ageEncrypter(keys []string) (*encrypter, error) {
+	recipients := make([]age.Recipient, len(keys))
+	for i, key := range keys {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encrypt.age recipient `%s': %s", key, err)
+		}
+		recipients[i] = recipient
+	}
+	return &encrypter{
+		extension: ".age",
+		encrypt: func(w io.Writer) (io.WriteCloser, error) {
+			return age.Encrypt(w, recipients...)
+		},
+	}, nil
+}
+
+func gpgEncrypter(keys []string) (*encrypter, error) {
+	var recipients openpgp.EntityList
+	for i, key := range keys {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encrypt.gpg[%d] public key: %s", i, err)
+		}
+		recipients = append(recipients, entities...)
+	}
+	e := &encrypter{
+		extension: ".gpg",
+		encrypt: func(w io.Writer) (io.WriteCloser, error) {
+			return openpgp.Encrypt(w, recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+		},
+	}
+	// Keys without an encryption subkey are only rejected once a message is
+	// encrypted to them, so try one before fetching any secrets.
+	plaintext, err := e.encrypt(ioutil.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt to encrypt.gpg keys: %s", err)
+	}
+	return e, plaintext.Close()
+}
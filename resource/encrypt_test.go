@@ -0,0 +1,166 @@
+package resource_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Encryption", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		outDir     string
+		identity   *age.X25519Identity
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	in := func(params oc.Params) error {
+		_, _, err := r.In(outDir, source, params, oc.Version{}, env, testLogger)
+		return err
+	}
+
+	ageDecrypt := func(name string) []byte {
+		f, err := os.Open(filepath.Join(outDir, name))
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		plaintext, err := age.Decrypt(f, identity)
+		Expect(err).ToNot(HaveOccurred())
+		raw, err := ioutil.ReadAll(plaintext)
+		Expect(err).ToNot(HaveOccurred())
+		return raw
+	}
+
+	// writtenFiles lists every file In wrote, to show none is plaintext.
+	writtenFiles := func() []string {
+		files := []string{}
+		Expect(filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(outDir, path)
+				files = append(files, rel)
+			}
+			return err
+		})).To(Succeed())
+		return files
+	}
+
+	BeforeEach(func() {
+		var err error
+		outDir, err = ioutil.TempDir("", "vault-concourse-encrypt")
+		Expect(err).ToNot(HaveOccurred())
+		identity, err = age.GenerateX25519Identity()
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Set("secret/app/db", map[string]string{"password": "one"})
+		vault.Set("secret/app/tls", map[string]string{"certificate": "cert"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/app"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(outDir)
+	})
+
+	It("should encrypt every file to age recipients", func() {
+		Expect(in(oc.Params{
+			"encrypt": map[string]interface{}{"age": []string{identity.Recipient().String()}},
+			"templates": []map[string]interface{}{
+				{"inline": `{{ secret "secret/app/db" "password" }}`, "output": "password.txt"},
+			},
+		})).To(Succeed())
+		Expect(writtenFiles()).To(ConsistOf("secret/app/db.age", "secret/app/tls.age", "password.txt.age"))
+		Expect(ageDecrypt("secret/app/db.age")).To(MatchJSON(`{"password": "one"}`))
+		Expect(string(ageDecrypt("password.txt.age"))).To(Equal("one"))
+	})
+
+	It("should encrypt a single tarball", func() {
+		Expect(in(oc.Params{
+			"format":  "files",
+			"encrypt": map[string]interface{}{"age": []string{identity.Recipient().String()}, "tarball": true},
+		})).To(Succeed())
+		Expect(writtenFiles()).To(ConsistOf("secrets.tar.age"))
+
+		contents := map[string]string{}
+		tr := tar.NewReader(bytes.NewReader(ageDecrypt("secrets.tar.age")))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			raw, err := ioutil.ReadAll(tr)
+			Expect(err).ToNot(HaveOccurred())
+			contents[h.Name] = string(raw)
+			if h.Typeflag == tar.TypeReg {
+				Expect(h.Mode).To(BeEquivalentTo(0600))
+			}
+		}
+		Expect(contents).To(Equal(map[string]string{
+			"secret/":                    "",
+			"secret/app/":                "",
+			"secret/app/db/":             "",
+			"secret/app/db/password":     "one",
+			"secret/app/tls/":            "",
+			"secret/app/tls/certificate": "cert",
+		}))
+	})
+
+	It("should encrypt every file to GPG keys", func() {
+		entity, err := openpgp.NewEntity("concourse", "", "ci@example.com", nil)
+		Expect(err).ToNot(HaveOccurred())
+		var publicKey bytes.Buffer
+		w, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entity.Serialize(w)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+
+		Expect(in(oc.Params{
+			"format":  "env",
+			"encrypt": map[string]interface{}{"gpg": []string{publicKey.String()}},
+		})).To(Succeed())
+		Expect(writtenFiles()).To(ConsistOf("secrets.env.gpg"))
+
+		f, err := os.Open(filepath.Join(outDir, "secrets.env.gpg"))
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		md, err := openpgp.ReadMessage(f, openpgp.EntityList{entity}, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		raw, err := ioutil.ReadAll(md.UnverifiedBody)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(raw)).To(Equal("SECRET_APP_DB_PASSWORD='one'\nSECRET_APP_TLS_CERTIFICATE='cert'\n"))
+	})
+
+	It("should reject invalid recipients before fetching secrets", func() {
+		err := in(oc.Params{"encrypt": map[string]interface{}{"age": []string{"age1nope"}}})
+		Expect(err).To(MatchError(ContainSubstring("Invalid encrypt.age recipient `age1nope'")))
+		err = in(oc.Params{"encrypt": map[string]interface{}{"gpg": []string{"not a key"}}})
+		Expect(err).To(MatchError(ContainSubstring("Invalid encrypt.gpg[0] public key")))
+		Expect(vault.Requests()).ToNot(ContainElement(ContainSubstring("secret/app")))
+	})
+
+	It("should only encrypt to one kind of key", func() {
+		err := in(oc.Params{"encrypt": map[string]interface{}{
+			"age": []string{identity.Recipient().String()},
+			"gpg": []string{strings.Repeat("x", 10)},
+		}})
+		Expect(err).To(MatchError(ContainSubstring("Only one of encrypt.age and encrypt.gpg")))
+	})
+})
@@ -0,0 +1,95 @@
+package resource_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mount declares a KV mount of the given version (1 or 2).
+func (v *fakeVault) Mount(mount string, version int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.mounts[strings.Trim(mount, "/")] = version
+}
+
+// Destroy marks the given version of the secret at path as destroyed.
+func (v *fakeVault) Destroy(path string, version int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.secrets[strings.Trim(path, "/")][version-1].destroyed = true
+}
+
+func (v *fakeVault) serveV2(w http.ResponseWriter, req *http.Request, method, mount, subpath string) {
+	parts := strings.SplitN(subpath, "/", 2)
+	kind := parts[0]
+	secretPath := mount
+	if len(parts) > 1 && parts[1] != "" {
+		secretPath = mount + "/" + parts[1]
+	}
+	versions := v.secrets[secretPath]
+
+	switch {
+	case kind == "metadata" && method == "LIST":
+		v.serveList(w, secretPath)
+	case kind == "metadata" && method == "GET":
+		if len(versions) == 0 {
+			writeFakeError(w, http.StatusNotFound, "")
+			return
+		}
+		meta := map[string]interface{}{}
+		for i, version := range versions {
+			meta[strconv.Itoa(i+1)] = map[string]interface{}{
+				"created_time":  version.created.Format(time.RFC3339Nano),
+				"deletion_time": "",
+				"destroyed":     version.destroyed,
+			}
+		}
+		writeFakeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{
+				"current_version": len(versions),
+				"oldest_version":  1,
+				"created_time":    versions[0].created.Format(time.RFC3339Nano),
+				"updated_time":    versions[len(versions)-1].created.Format(time.RFC3339Nano),
+				"versions":        meta,
+			},
+		})
+	case kind == "data" && method == "GET":
+		number := len(versions)
+		if requested, _ := strconv.Atoi(req.URL.Query().Get("version")); requested > 0 {
+			number = requested
+		}
+		if number == 0 || number > len(versions) || versions[number-1].destroyed {
+			writeFakeError(w, http.StatusNotFound, "")
+			return
+		}
+		version := versions[number-1]
+		writeFakeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": version.data,
+				"metadata": map[string]interface{}{
+					"created_time":  version.created.Format(time.RFC3339Nano),
+					"deletion_time": "",
+					"destroyed":     false,
+					"version":       number,
+				},
+			},
+		})
+	case kind == "data" && (method == "PUT" || method == "POST"):
+		body := struct {
+			Data map[string]string `json:"data"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeFakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		number := v.set(secretPath, body.Data)
+		writeFakeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{"version": number},
+		})
+	default:
+		writeFakeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
@@ -0,0 +1,142 @@
+package resource_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type fakeToken struct {
+	parent    string
+	ttl       time.Duration
+	expires   time.Time
+	renewable bool
+	numUses   int
+}
+
+// IssueToken hands out a new token, as an auth backend login would.
+func (v *fakeVault) IssueToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.issueToken("", v.TokenTTL, 0)
+}
+
+// ValidToken reports whether token was issued and has not been revoked.
+func (v *fakeVault) ValidToken(token string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return token == v.Token || v.liveToken(token) != nil
+}
+
+// LiveTokens returns the number of issued tokens not yet revoked or expired.
+func (v *fakeVault) LiveTokens() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	live := 0
+	for token := range v.tokens {
+		if v.liveToken(token) != nil {
+			live++
+		}
+	}
+	return live
+}
+
+func (v *fakeVault) issueToken(parent string, ttl time.Duration, numUses int) string {
+	v.issued++
+	token := fmt.Sprintf("fake-token-%d", v.issued)
+	v.tokens[token] = &fakeToken{
+		parent:    parent,
+		ttl:       ttl,
+		expires:   time.Now().Add(ttl),
+		renewable: v.TokenRenewable,
+		numUses:   numUses,
+	}
+	return token
+}
+
+func (v *fakeVault) liveToken(token string) *fakeToken {
+	t := v.tokens[token]
+	if t == nil || time.Now().After(t.expires) {
+		return nil
+	}
+	// Like vault, a child does not outlive its parent token.
+	if t.parent != "" && t.parent != v.Token && v.liveToken(t.parent) == nil {
+		return nil
+	}
+	return t
+}
+
+func (v *fakeVault) revokeToken(token string) {
+	delete(v.tokens, token)
+	for child, t := range v.tokens {
+		if t.parent == token {
+			v.revokeToken(child)
+		}
+	}
+}
+
+// useToken reports whether token may make a request, counting the request
+// against the token's num_uses.
+func (v *fakeVault) useToken(token string) bool {
+	if token != v.Token && v.liveToken(token) == nil {
+		return false
+	}
+	if t := v.tokens[token]; t != nil && t.numUses > 0 {
+		t.numUses--
+		if t.numUses == 0 {
+			v.revokeToken(token)
+		}
+	}
+	return true
+}
+
+func (v *fakeVault) serveToken(w http.ResponseWriter, req *http.Request, path, token string) {
+	switch {
+	case path == "auth/token/lookup-self":
+		ttl, renewable := 0, false
+		if t := v.tokens[token]; t != nil {
+			ttl, renewable = int(time.Until(t.expires).Seconds()+0.5), t.renewable
+		}
+		writeFakeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{"ttl": ttl, "renewable": renewable},
+		})
+	case path == "auth/token/renew-self":
+		t := v.tokens[token]
+		if t == nil || !t.renewable {
+			writeFakeError(w, http.StatusBadRequest, "lease is not renewable")
+			return
+		}
+		t.expires = time.Now().Add(t.ttl)
+		writeFakeJSON(w, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   token,
+				"lease_duration": int(t.ttl.Seconds()),
+				"renewable":      true,
+			},
+		})
+	case path == "auth/token/revoke-self":
+		v.revokeToken(token)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "auth/token/create":
+		body := struct {
+			TTL     string `json:"ttl"`
+			NumUses int    `json:"num_uses"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&body)
+		ttl, _ := time.ParseDuration(body.TTL)
+		if ttl == 0 {
+			ttl = v.TokenTTL
+		}
+		child := v.issueToken(token, ttl, body.NumUses)
+		writeFakeJSON(w, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   child,
+				"lease_duration": int(ttl.Seconds()),
+				"renewable":      true,
+			},
+		})
+	default:
+		writeFakeError(w, http.StatusNotFound, "no handler for route")
+	}
+}
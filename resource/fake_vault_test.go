@@ -0,0 +1,288 @@
+package resource_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeVault is a minimal stand-in for the Vault HTTP API, serving KV v1
+// mounts from memory so specs can run without a real Vault binary. KV v2
+// mounts are served by fake_kv2_test.go and token auth by fake_tokens_test.go.
+type fakeVault struct {
+	*httptest.Server
+	Token string
+	// TokenTTL and TokenRenewable apply to tokens issued after they are set.
+	TokenTTL       time.Duration
+	TokenRenewable bool
+	// Delay is added to every KV request.
+	Delay time.Duration
+	// RetryAfter is sent as the Retry-After header of failures from Fail.
+	RetryAfter string
+
+	mu       sync.Mutex
+	mounts   map[string]int
+	secrets  map[string][]*fakeSecretVersion
+	handlers map[string]http.HandlerFunc
+	failures map[string][]int
+	requests []string
+	tokens   map[string]*fakeToken
+	issued   int
+	inFlight int
+	// maxInFlight is the most requests served at once.
+	maxInFlight int
+}
+
+type fakeSecretVersion struct {
+	data      map[string]string
+	created   time.Time
+	destroyed bool
+}
+
+func newFakeVault() *fakeVault {
+	v := newUnstartedFakeVault()
+	v.Start()
+	return v
+}
+
+func newUnstartedFakeVault() *fakeVault {
+	v := &fakeVault{
+		Token:          "fake-root-token",
+		TokenTTL:       time.Hour,
+		TokenRenewable: true,
+		mounts:         map[string]int{"secret": 1},
+		secrets:        map[string][]*fakeSecretVersion{},
+		handlers:       map[string]http.HandlerFunc{},
+		failures:       map[string][]int{},
+		tokens:         map[string]*fakeToken{},
+	}
+	v.Server = httptest.NewUnstartedServer(http.HandlerFunc(v.serveHTTP))
+	return v
+}
+
+// Set writes a new version of the secret at path.
+func (v *fakeVault) Set(path string, data map[string]string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.set(strings.Trim(path, "/"), data)
+}
+
+// Handle overrides the response for requests to the given API path, such as
+// "auth/kubernetes/login".
+func (v *fakeVault) Handle(path string, handler http.HandlerFunc) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.handlers[strings.Trim(path, "/")] = handler
+}
+
+// Fail makes the next requests matching request, given as "METHOD path" like
+// the entries of Requests, fail with the given status codes, one per request,
+// before they are served as usual again.
+func (v *fakeVault) Fail(request string, codes ...int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.failures[request] = append(v.failures[request], codes...)
+}
+
+// Requests returns every request served so far as "METHOD path".
+func (v *fakeVault) Requests() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]string{}, v.requests...)
+}
+
+// MaxInFlight returns the most requests served at once so far.
+func (v *fakeVault) MaxInFlight() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.maxInFlight
+}
+
+// Get returns the latest value of the secret at path.
+func (v *fakeVault) Get(path string) map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	versions := v.secrets[strings.Trim(path, "/")]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1].data
+}
+
+func (v *fakeVault) set(path string, data map[string]string) int {
+	mount, _ := v.mountFor(path)
+	if v.mounts[mount] == 1 {
+		v.secrets[path] = nil
+	}
+	v.secrets[path] = append(v.secrets[path], &fakeSecretVersion{
+		data:    data,
+		created: time.Now().UTC(),
+	})
+	return len(v.secrets[path])
+}
+
+func (v *fakeVault) mountFor(path string) (string, string) {
+	parts := strings.Split(path, "/")
+	for i := len(parts); i > 0; i-- {
+		mount := strings.Join(parts[:i], "/")
+		if _, ok := v.mounts[mount]; ok {
+			return mount, strings.Join(parts[i:], "/")
+		}
+	}
+	return "", path
+}
+
+func (v *fakeVault) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/"), "/")
+	method := req.Method
+	if method == "GET" && req.URL.Query().Get("list") == "true" {
+		method = "LIST"
+	}
+
+	v.mu.Lock()
+	request := fmt.Sprintf("%s %s", method, path)
+	v.requests = append(v.requests, request)
+	handler := v.handlers[path]
+	failure := 0
+	if codes := v.failures[request]; len(codes) > 0 {
+		failure, v.failures[request] = codes[0], codes[1:]
+	}
+	v.inFlight++
+	if v.inFlight > v.maxInFlight {
+		v.maxInFlight = v.inFlight
+	}
+	v.mu.Unlock()
+	defer func() {
+		v.mu.Lock()
+		v.inFlight--
+		v.mu.Unlock()
+	}()
+	if failure != 0 {
+		if v.RetryAfter != "" {
+			w.Header().Set("Retry-After", v.RetryAfter)
+		}
+		writeFakeError(w, failure, http.StatusText(failure))
+		return
+	}
+	if handler != nil {
+		handler(w, req)
+		return
+	}
+
+	if !strings.HasPrefix(path, "sys/") && !strings.HasPrefix(path, "auth/") {
+		defer time.Sleep(v.Delay)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	token := req.Header.Get("X-Vault-Token")
+	if !v.useToken(token) {
+		writeFakeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case path == "sys/internal/ui/mounts":
+		v.serveMounts(w)
+	case strings.HasPrefix(path, "auth/token/"):
+		v.serveToken(w, req, path, token)
+	default:
+		mount, subpath := v.mountFor(path)
+		switch v.mounts[mount] {
+		case 1:
+			v.serveV1(w, req, method, path)
+		case 2:
+			v.serveV2(w, req, method, mount, subpath)
+		default:
+			writeFakeError(w, http.StatusNotFound, "no handler for route")
+		}
+	}
+}
+
+func (v *fakeVault) serveMounts(w http.ResponseWriter) {
+	secret := map[string]interface{}{}
+	for mount, version := range v.mounts {
+		secret[mount+"/"] = map[string]interface{}{
+			"type":    "kv",
+			"options": map[string]string{"version": strconv.Itoa(version)},
+		}
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{"secret": secret},
+	})
+}
+
+func (v *fakeVault) serveV1(w http.ResponseWriter, req *http.Request, method, path string) {
+	switch method {
+	case "LIST":
+		v.serveList(w, path)
+	case "GET":
+		versions := v.secrets[path]
+		if len(versions) == 0 {
+			writeFakeError(w, http.StatusNotFound, "")
+			return
+		}
+		writeFakeJSON(w, map[string]interface{}{"data": versions[0].data})
+	case "PUT", "POST":
+		data := map[string]string{}
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			writeFakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		v.set(path, data)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(v.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func (v *fakeVault) serveList(w http.ResponseWriter, dir string) {
+	prefix := strings.Trim(dir, "/") + "/"
+	seen := map[string]bool{}
+	for path := range v.secrets {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(path, prefix)
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			rest = rest[:idx+1]
+		}
+		seen[rest] = true
+	}
+	if len(seen) == 0 {
+		writeFakeError(w, http.StatusNotFound, "")
+		return
+	}
+	keys := []string{}
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeFakeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{"keys": keys},
+	})
+}
+
+func writeFakeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	errors := []string{}
+	if message != "" {
+		errors = append(errors, message)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors})
+}
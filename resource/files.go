@@ -0,0 +1,256 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes In gives the files and directories it writes when file_mode and
+// dir_mode are not set, so only their owner can read the secrets. That is
+// the user the resource runs as, usually root, unless owner is set.
+const (
+	defaultFileMode os.FileMode = 0600
+	defaultDirMode  os.FileMode = 0700
+)
+
+func (p *InParams) parseFileOptions() error {
+	var err error
+	if p.fileMode, err = parseMode("file_mode", p.FileMode, defaultFileMode); err != nil {
+		return err
+	}
+	if p.dirMode, err = parseMode("dir_mode", p.DirMode, defaultDirMode); err != nil {
+		return err
+	}
+	p.uid, p.gid = -1, -1
+	if p.Owner == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("owner can only be set when running as root")
+	}
+	owner, group := p.Owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		owner, group = owner[:i], owner[i+1:]
+	}
+	if p.uid, err = lookupID(owner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	}); err != nil {
+		return fmt.Errorf("Invalid owner `%s': %s", p.Owner, err)
+	}
+	if group == "" {
+		return nil
+	}
+	if p.gid, err = lookupID(group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	}); err != nil {
+		return fmt.Errorf("Invalid owner `%s': %s", p.Owner, err)
+	}
+	return nil
+}
+
+func parseMode(field, value string, defaultMode os.FileMode) (os.FileMode, error) {
+	if value == "" {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid %s `%s', expected octal permissions such as `0600'", field, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupID returns the numeric ID named by s, looking up names with lookup.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// fileWriter writes files below dir with the modes and ownership of the in
+// params, whatever the umask, creating missing directories the same way. With
+// an encrypter, each file is encrypted as it is written, or added to a single
+// encrypted tarball, so no plaintext reaches the disk.
+type fileWriter struct {
+	dir       string
+	fileMode  os.FileMode
+	dirMode   os.FileMode
+	uid, gid  int
+	made      map[string]bool
+	encrypter *encrypter
+	tar       *tar.Writer
+	closers   []io.Closer
+}
+
+func (p InParams) fileWriter(dir string) (*fileWriter, error) {
+	w := &fileWriter{
+		dir:       filepath.Clean(dir),
+		fileMode:  p.fileMode,
+		dirMode:   p.dirMode,
+		uid:       p.uid,
+		gid:       p.gid,
+		made:      map[string]bool{},
+		encrypter: p.encrypter,
+	}
+	if !p.Encrypt.Tarball {
+		return w, nil
+	}
+	f, err := w.create("secrets.tar" + w.encrypter.extension)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := w.encrypter.encrypt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.tar = tar.NewWriter(plaintext)
+	w.closers = []io.Closer{w.tar, plaintext, f}
+	return w, nil
+}
+
+func (w *fileWriter) write(name string, raw []byte) error {
+	if w.tar != nil {
+		return w.writeTarEntry(filepath.Clean(name), raw)
+	}
+	if w.encrypter != nil {
+		name += w.encrypter.extension
+	}
+	f, err := w.create(name)
+	if err != nil {
+		return err
+	}
+	var out io.WriteCloser = f
+	if w.encrypter != nil {
+		out, err = w.encrypter.encrypt(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	_, err = out.Write(raw)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if out != f {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// close finishes the encrypted tarball, if there is one.
+func (w *fileWriter) close() error {
+	var err error
+	for _, c := range w.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (w *fileWriter) create(name string) (*os.File, error) {
+	filePath := filepath.Join(w.dir, name)
+	if err := w.mkdirAll(filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, w.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.setPermissions(filePath, w.fileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (w *fileWriter) mkdirAll(dir string) error {
+	if dir == w.dir || dir == filepath.Dir(dir) || w.made[dir] {
+		return nil
+	}
+	if err := w.mkdirAll(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, w.dirMode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	w.made[dir] = true
+	return w.setPermissions(dir, w.dirMode)
+}
+
+func (w *fileWriter) setPermissions(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if w.uid == -1 && w.gid == -1 {
+		return nil
+	}
+	return os.Chown(path, w.uid, w.gid)
+}
+
+// writeTarEntry adds a file to the tarball, after entries for the directories
+// above it.
+func (w *fileWriter) writeTarEntry(name string, raw []byte) error {
+	if err := w.addTarDirs(filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := w.tar.WriteHeader(w.tarHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Mode:     int64(w.fileMode),
+		Size:     int64(len(raw)),
+	})); err != nil {
+		return err
+	}
+	_, err := w.tar.Write(raw)
+	return err
+}
+
+func (w *fileWriter) addTarDirs(dir string) error {
+	if dir == "." || dir == filepath.Dir(dir) || w.made[dir] {
+		return nil
+	}
+	if err := w.addTarDirs(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	w.made[dir] = true
+	return w.tar.WriteHeader(w.tarHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     filepath.ToSlash(dir) + "/",
+		Mode:     int64(w.dirMode),
+	}))
+}
+
+func (w *fileWriter) tarHeader(h *tar.Header) *tar.Header {
+	h.ModTime = time.Now()
+	if w.uid != -1 {
+		h.Uid = w.uid
+	}
+	if w.gid != -1 {
+		h.Gid = w.gid
+	}
+	return h
+}
@@ -0,0 +1,140 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// regexPrefix marks a filter pattern as a regular expression instead of a glob.
+const regexPrefix = "regex:"
+
+// filter selects the secret paths and keys a resource works with, from the
+// source's include, exclude, include_keys and exclude_keys patterns.
+type filter struct {
+	include     []*regexp.Regexp
+	exclude     []*regexp.Regexp
+	includeKeys []*regexp.Regexp
+	excludeKeys []*regexp.Regexp
+}
+
+func (s *Source) compileFilter() error {
+	var f filter
+	var err error
+	if f.include, err = compilePatterns("include", s.Include); err != nil {
+		return err
+	}
+	if f.exclude, err = compilePatterns("exclude", s.Exclude); err != nil {
+		return err
+	}
+	if f.includeKeys, err = compilePatterns("include_keys", s.IncludeKeys); err != nil {
+		return err
+	}
+	if f.excludeKeys, err = compilePatterns("exclude_keys", s.ExcludeKeys); err != nil {
+		return err
+	}
+	s.filter = f
+	return nil
+}
+
+func compilePatterns(field string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := globToRegexp(sv.Canonicalize(pattern))
+		if strings.HasPrefix(pattern, regexPrefix) {
+			expr = strings.TrimPrefix(pattern, regexPrefix)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s pattern `%s': %s", field, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// globToRegexp translates a glob, where `*` and `?` stop at slashes and `**`
+// does not, into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func matches(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func selected(include, exclude []*regexp.Regexp, s string) bool {
+	if len(include) > 0 && !matches(include, s) {
+		return false
+	}
+	return !matches(exclude, s)
+}
+
+// path reports whether the secret at path is selected.
+func (f filter) path(path string) bool {
+	return selected(f.include, f.exclude, sv.Canonicalize(path))
+}
+
+// filtersKeys reports whether the filter selects keys within secrets.
+func (f filter) filtersKeys() bool {
+	return len(f.includeKeys) > 0 || len(f.excludeKeys) > 0
+}
+
+// keys returns a copy of secret holding only its selected keys.
+func (f filter) keys(secret *sv.Secret) *sv.Secret {
+	if !f.filtersKeys() {
+		return secret
+	}
+	ret := sv.NewSecret()
+	for _, key := range secret.Keys() {
+		if selected(f.includeKeys, f.excludeKeys, key) {
+			ret.Set(key, secret.Get(key), false)
+		}
+	}
+	return ret
+}
+
+// secrets returns the selected secrets, holding only their selected keys.
+func (f filter) secrets(secrets sv.Secrets) sv.Secrets {
+	ret := sv.Secrets{}
+	for _, s := range secrets {
+		if !f.path(s.Path) {
+			continue
+		}
+		versions := make([]sv.SecretVersion, len(s.Versions))
+		for i, v := range s.Versions {
+			versions[i] = v
+			if v.Data != nil {
+				versions[i].Data = f.keys(v.Data)
+			}
+		}
+		ret.Append(sv.SecretEntry{Path: s.Path, Versions: versions})
+	}
+	return ret
+}
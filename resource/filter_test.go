@@ -0,0 +1,128 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Filters", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		dir        string
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	check := func(version oc.Version) oc.Version {
+		versions, err := r.Check(source, version, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		return versions[len(versions)-1]
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "vault-concourse-filter")
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Mount("kv", 2)
+		for _, mount := range []string{"secret", "kv"} {
+			vault.Set(mount+"/app/web/db", map[string]string{"password": "one", "user": "web"})
+			vault.Set(mount+"/app/worker/db", map[string]string{"password": "two", "user": "worker"})
+			vault.Set(mount+"/app/web/cache", map[string]string{"password": "three"})
+		}
+		source = oc.Source{
+			"url":     vault.URL,
+			"token":   vault.Token,
+			"paths":   []string{"secret/app"},
+			"include": []string{"secret/app/*/db"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should reject invalid patterns", func() {
+		source["exclude"] = []string{"regex:("}
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("Invalid exclude pattern")))
+	})
+
+	for _, mount := range []string{"secret", "kv"} {
+		mount := mount
+
+		Context("on the "+mount+" mount", func() {
+			BeforeEach(func() {
+				source["paths"] = []string{mount + "/app"}
+				source["include"] = []string{mount + "/app/*/db"}
+			})
+
+			It("should only version the included paths", func() {
+				source["version_key"] = "pipeline-key"
+				version := check(nil)
+				tracked := version["paths"] + version["kv_versions"]
+				Expect(tracked).To(ContainSubstring(mount + "/app/web/db"))
+				Expect(tracked).To(ContainSubstring(mount + "/app/worker/db"))
+				Expect(tracked).ToNot(ContainSubstring("cache"))
+
+				vault.Set(mount+"/app/web/cache", map[string]string{"password": "changed"})
+				Expect(check(version)).To(Equal(version))
+
+				vault.Set(mount+"/app/web/db", map[string]string{"password": "changed", "user": "web"})
+				Expect(check(version)).ToNot(Equal(version))
+			})
+
+			It("should leave out excluded paths", func() {
+				source["exclude"] = []string{"regex:/worker/"}
+				source["version_key"] = "pipeline-key"
+				version := check(nil)
+				Expect(version["paths"] + version["kv_versions"]).ToNot(ContainSubstring("worker"))
+			})
+
+			It("should only version the selected keys", func() {
+				source["include_keys"] = []string{"pass*"}
+				version := check(nil)
+
+				vault.Set(mount+"/app/web/db", map[string]string{"password": "one", "user": "changed"})
+				Expect(check(version)).To(Equal(version))
+
+				vault.Set(mount+"/app/web/db", map[string]string{"password": "changed", "user": "changed"})
+				Expect(check(version)).ToNot(Equal(version))
+			})
+		})
+	}
+
+	It("should only fetch the selected paths and keys", func() {
+		source["exclude_keys"] = []string{"user"}
+		_, _, err := r.In(dir, source, oc.Params{}, oc.Version{}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "secret/app/web/db"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(raw).To(MatchJSON(`{"password": "one"}`))
+		Expect(filepath.Join(dir, "secret/app/worker/db")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "secret/app/web/cache")).ToNot(BeAnExistingFile())
+	})
+
+	It("should only write the selected paths and keys", func() {
+		Expect(os.MkdirAll(filepath.Join(dir, "app/web"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "app/web/db"),
+			[]byte(`{"password": "new", "user": "new"}`), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "app/web/cache"),
+			[]byte(`{"password": "new"}`), 0600)).To(Succeed())
+		source["include_keys"] = []string{"password"}
+
+		_, _, err := r.Out(dir, source, oc.Params{"path": ".", "prefix": "secret"}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vault.Get("secret/app/web/db")).To(Equal(map[string]string{"password": "new", "user": "web"}))
+		Expect(vault.Get("secret/app/web/cache")).To(Equal(map[string]string{"password": "three"}))
+	})
+})
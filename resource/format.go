@@ -0,0 +1,201 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	sv "github.com/starkandwayne/safe/vault"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultFormat is how In writes secrets when format is not set.
+const defaultFormat = "json"
+
+// inFormats are the formats In can write secrets in.
+var inFormats = []string{"json", "yaml", "env", "properties", "files"}
+
+func knownFormat(format string) bool {
+	for _, f := range inFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSecrets writes the secrets with w in the format of p: one JSON or
+// YAML file per secret path, a single JSON or YAML file mapping each path to
+// its secret, a single dotenv or properties file, or a file per key.
+func (p InParams) writeSecrets(w *fileWriter, secrets sv.Secrets) error {
+	switch {
+	case p.Format == "files":
+		return writeKeyFiles(w, secrets)
+	case p.Format == "env":
+		raw, err := envFile(secrets)
+		if err != nil {
+			return err
+		}
+		return w.write("secrets.env", raw)
+	case p.Format == "properties":
+		return w.write("secrets.properties", propertiesFile(secrets))
+	case p.SingleFile:
+		tree := map[string]map[string]string{}
+		for _, s := range secrets {
+			tree[s.Path] = secretData(s.Versions[0].Data)
+		}
+		raw, err := p.marshal(tree)
+		if err != nil {
+			return err
+		}
+		return w.write("secrets."+p.extension(), raw)
+	}
+	for _, s := range secrets {
+		raw, err := p.marshal(secretData(s.Versions[0].Data))
+		if err != nil {
+			return err
+		}
+		if err := w.write(s.Path, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p InParams) marshal(v interface{}) ([]byte, error) {
+	if p.Format == "yaml" {
+		return yaml.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+func (p InParams) extension() string {
+	if p.Format == "yaml" {
+		return "yml"
+	}
+	return p.Format
+}
+
+// writeKeyFiles writes each key of a secret to its own file, named after the
+// key in a directory named after the secret's path, holding the raw value, the
+// way Kubernetes mounts secrets.
+func writeKeyFiles(w *fileWriter, secrets sv.Secrets) error {
+	// taken holds every secret path and the directories above them.
+	taken := map[string]string{}
+	for _, s := range secrets {
+		for p := s.Path; p != "." && p != "/"; p = path.Dir(p) {
+			taken[p] = s.Path
+		}
+	}
+	for _, s := range secrets {
+		for _, key := range s.Versions[0].Data.Keys() {
+			if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+				return fmt.Errorf("Key `%s' of `%s' is not a valid file name", key, s.Path)
+			}
+			name := s.Path + "/" + key
+			if other, ok := taken[name]; ok {
+				return fmt.Errorf("Key `%s' of `%s' would be written where the secret `%s' is", key, s.Path, other)
+			}
+			if err := w.write(name, []byte(s.Versions[0].Data.Get(key))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func secretData(secret *sv.Secret) map[string]string {
+	data := map[string]string{}
+	for _, key := range secret.Keys() {
+		data[key] = secret.Get(key)
+	}
+	return data
+}
+
+// envFile renders the secrets as dotenv lines such as SECRET_APP_DB_PASSWORD='value',
+// naming each variable after the secret's path and key and quoting values so
+// the file can be sourced by a shell.
+func envFile(secrets sv.Secrets) ([]byte, error) {
+	var b strings.Builder
+	names := map[string]string{}
+	for _, s := range secrets {
+		for _, key := range s.Versions[0].Data.Keys() {
+			name := envName(s.Path + "/" + key)
+			if other, taken := names[name]; taken {
+				return nil, fmt.Errorf("Both `%s' and `%s:%s' would be written as %s", other, s.Path, key, name)
+			}
+			names[name] = s.Path + ":" + key
+			value := strings.Replace(s.Versions[0].Data.Get(key), "'", `'\''`, -1)
+			fmt.Fprintf(&b, "%s='%s'\n", name, value)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// envName turns a secret path and key into an environment variable name,
+// upper-casing letters and replacing anything else but digits with underscores.
+func envName(s string) string {
+	name := []byte(strings.ToUpper(s))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// propertiesFile renders the secrets as Java properties named after each
+// secret's path and key, such as secret.app.db.password.
+func propertiesFile(secrets sv.Secrets) []byte {
+	var b strings.Builder
+	for _, s := range secrets {
+		prefix := strings.Replace(s.Path, "/", ".", -1)
+		for _, key := range s.Versions[0].Data.Keys() {
+			fmt.Fprintf(&b, "%s=%s\n",
+				escapeProperty(prefix+"."+key, true),
+				escapeProperty(s.Versions[0].Data.Get(key), false))
+		}
+	}
+	return []byte(b.String())
+}
+
+// escapeProperty escapes a properties key or value so java.util.Properties
+// reads it back unchanged.
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\f':
+			b.WriteString(`\f`)
+		case c == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case strings.ContainsRune("=:#!", c):
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			if r1, r2 := utf16.EncodeRune(c); r1 != unicode.ReplacementChar {
+				fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+			} else {
+				fmt.Fprintf(&b, `\u%04x`, c)
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,278 @@
+package resource_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+	"gopkg.in/yaml.v2"
+)
+
+var _ = Describe("In", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		outDir     string
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	readSecret := func(path string) map[string]string {
+		raw, err := ioutil.ReadFile(filepath.Join(outDir, path))
+		Expect(err).ToNot(HaveOccurred())
+		secret := map[string]string{}
+		Expect(json.Unmarshal(raw, &secret)).To(Succeed())
+		return secret
+	}
+
+	BeforeEach(func() {
+		var err error
+		outDir, err = ioutil.TempDir("", "vault-concourse-in")
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Mount("kv", 2)
+		vault.Set("kv/app/db", map[string]string{"password": "one"})
+		vault.Set("kv/app/tls", map[string]string{"certificate": "cert"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"kv/app"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(outDir)
+	})
+
+	Describe("KV versions", func() {
+		var version oc.Version
+
+		BeforeEach(func() {
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			version = versions[0]
+			vault.Set("kv/app/db", map[string]string{"password": "two"})
+			vault.Set("kv/app/new", map[string]string{"added": "later"})
+		})
+
+		It("should fetch the KV versions recorded in the version", func() {
+			_, _, err := r.In(outDir, source, oc.Params{}, version, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readSecret("kv/app/db")).To(Equal(map[string]string{"password": "one"}))
+			Expect(readSecret("kv/app/tls")).To(Equal(map[string]string{"certificate": "cert"}))
+			Expect(filepath.Join(outDir, "kv/app/new")).ToNot(BeAnExistingFile())
+		})
+
+		It("should fail when a recorded KV version has been destroyed", func() {
+			vault.Destroy("kv/app/db", 1)
+			_, _, err := r.In(outDir, source, oc.Params{}, version, env, testLogger)
+			Expect(err).To(MatchError(ContainSubstring("Version 1 of `kv/app/db' has been deleted or destroyed")))
+		})
+
+		It("should fetch current values of paths the version recorded nothing under", func() {
+			vault.Set("kv/other/x", map[string]string{"added": "to paths"})
+			source["paths"] = []string{"kv/app", "kv/other"}
+			_, _, err := r.In(outDir, source, oc.Params{}, version, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readSecret("kv/app/db")).To(Equal(map[string]string{"password": "one"}))
+			Expect(readSecret("kv/other/x")).To(Equal(map[string]string{"added": "to paths"}))
+		})
+
+		It("should fetch current values for versions without KV versions", func() {
+			delete(version, "kv_versions")
+			_, _, err := r.In(outDir, source, oc.Params{}, version, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readSecret("kv/app/db")).To(Equal(map[string]string{"password": "two"}))
+			Expect(readSecret("kv/app/new")).To(Equal(map[string]string{"added": "later"}))
+		})
+	})
+
+	Describe("formats", func() {
+		readFile := func(name string) string {
+			raw, err := ioutil.ReadFile(filepath.Join(outDir, name))
+			Expect(err).ToNot(HaveOccurred())
+			return string(raw)
+		}
+
+		in := func(params oc.Params) error {
+			_, _, err := r.In(outDir, source, params, oc.Version{}, env, testLogger)
+			return err
+		}
+
+		BeforeEach(func() {
+			vault.Set("kv/app/tls", map[string]string{"certificate": "line one\nline 'two'"})
+		})
+
+		It("should write a YAML file per path", func() {
+			Expect(in(oc.Params{"format": "yaml"})).To(Succeed())
+			secret := map[string]string{}
+			Expect(yaml.Unmarshal([]byte(readFile("kv/app/tls")), &secret)).To(Succeed())
+			Expect(secret).To(Equal(map[string]string{"certificate": "line one\nline 'two'"}))
+		})
+
+		It("should write the whole tree to secrets.json", func() {
+			Expect(in(oc.Params{"single_file": true})).To(Succeed())
+			Expect(readFile("secrets.json")).To(MatchJSON(`{
+				"kv/app/db": {"password": "one"},
+				"kv/app/tls": {"certificate": "line one\nline 'two'"}
+			}`))
+			Expect(filepath.Join(outDir, "kv/app/db")).ToNot(BeAnExistingFile())
+		})
+
+		It("should write the whole tree to secrets.yml", func() {
+			Expect(in(oc.Params{"format": "yaml", "single_file": true})).To(Succeed())
+			tree := map[string]map[string]string{}
+			Expect(yaml.Unmarshal([]byte(readFile("secrets.yml")), &tree)).To(Succeed())
+			Expect(tree["kv/app/db"]).To(Equal(map[string]string{"password": "one"}))
+		})
+
+		It("should write a dotenv file a shell can source", func() {
+			Expect(in(oc.Params{"format": "env"})).To(Succeed())
+			Expect(readFile("secrets.env")).To(Equal(
+				"KV_APP_DB_PASSWORD='one'\n" +
+					`KV_APP_TLS_CERTIFICATE='line one` + "\n" + `line '\''two'\'''` + "\n"))
+			cmd := exec.Command("sh", "-c", `. ./secrets.env && printf %s "$KV_APP_TLS_CERTIFICATE"`)
+			cmd.Dir = outDir
+			out, err := cmd.CombinedOutput()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(out)).To(Equal("line one\nline 'two'"))
+		})
+
+		It("should refuse to write two secrets as the same variable", func() {
+			vault.Set("kv/app-db", map[string]string{"password": "two"})
+			source["paths"] = []string{"kv/app", "kv/app-db"}
+			Expect(in(oc.Params{"format": "env"})).To(MatchError(ContainSubstring("would be written as KV_APP_DB_PASSWORD")))
+		})
+
+		It("should write a properties file", func() {
+			Expect(in(oc.Params{"format": "properties"})).To(Succeed())
+			Expect(readFile("secrets.properties")).To(Equal(
+				"kv.app.db.password=one\n" +
+					`kv.app.tls.certificate=line one\nline 'two'` + "\n"))
+		})
+
+		It("should write each key to its own file", func() {
+			Expect(in(oc.Params{"format": "files"})).To(Succeed())
+			Expect(readFile("kv/app/db/password")).To(Equal("one"))
+			Expect(readFile("kv/app/tls/certificate")).To(Equal("line one\nline 'two'"))
+		})
+
+		It("should refuse to write a key where a secret is", func() {
+			vault.Set("kv/app", map[string]string{"db": "clash"})
+			Expect(in(oc.Params{"format": "files"})).To(MatchError(ContainSubstring(
+				"Key `db' of `kv/app' would be written where the secret `kv/app/db' is")))
+		})
+
+		It("should reject unknown formats", func() {
+			Expect(in(oc.Params{"format": "toml"})).To(MatchError(ContainSubstring("Unknown format `toml'")))
+		})
+	})
+
+	Describe("permissions", func() {
+		mode := func(name string) os.FileMode {
+			info, err := os.Stat(filepath.Join(outDir, name))
+			Expect(err).ToNot(HaveOccurred())
+			return info.Mode().Perm()
+		}
+
+		It("should only let the owner read the secrets by default", func() {
+			_, _, err := r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mode("kv")).To(Equal(os.FileMode(0700)))
+			Expect(mode("kv/app")).To(Equal(os.FileMode(0700)))
+			Expect(mode("kv/app/db")).To(Equal(os.FileMode(0600)))
+		})
+
+		It("should apply file_mode and dir_mode whatever the umask", func() {
+			params := oc.Params{"file_mode": "0664", "dir_mode": "0775", "format": "files"}
+			_, _, err := r.In(outDir, source, params, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mode("kv/app/db")).To(Equal(os.FileMode(0775)))
+			Expect(mode("kv/app/db/password")).To(Equal(os.FileMode(0664)))
+		})
+
+		It("should reject invalid modes", func() {
+			_, _, err := r.In(outDir, source, oc.Params{"file_mode": "rw"}, oc.Version{}, env, testLogger)
+			Expect(err).To(MatchError(ContainSubstring("Invalid file_mode `rw'")))
+		})
+
+		It("should give the files to owner", func() {
+			if os.Geteuid() != 0 {
+				_, _, err := r.In(outDir, source, oc.Params{"owner": "1234"}, oc.Version{}, env, testLogger)
+				Expect(err).To(MatchError(ContainSubstring("owner can only be set when running as root")))
+				return
+			}
+			_, _, err := r.In(outDir, source, oc.Params{"owner": "1234:5678"}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			for _, name := range []string{"kv/app", "kv/app/db"} {
+				info, err := os.Stat(filepath.Join(outDir, name))
+				Expect(err).ToNot(HaveOccurred())
+				stat := info.Sys().(*syscall.Stat_t)
+				Expect(stat.Uid).To(BeEquivalentTo(1234))
+				Expect(stat.Gid).To(BeEquivalentTo(5678))
+			}
+		})
+	})
+
+	Describe("templates", func() {
+		in := func(templates ...map[string]interface{}) error {
+			_, _, err := r.In(outDir, source, oc.Params{"templates": templates}, oc.Version{}, env, testLogger)
+			return err
+		}
+
+		readFile := func(name string) string {
+			raw, err := ioutil.ReadFile(filepath.Join(outDir, name))
+			Expect(err).ToNot(HaveOccurred())
+			return string(raw)
+		}
+
+		It("should render inline templates with the secret helpers", func() {
+			Expect(in(map[string]interface{}{
+				"inline": `password: {{ secret "kv/app/db" "password" | base64 }}` + "\n" +
+					`tls:` + "\n" + `{{ index . "kv/app/tls" | toYaml | indent 2 }}` + "\n",
+				"output": "config/app.yml",
+			})).To(Succeed())
+			Expect(readFile("config/app.yml")).To(Equal("password: b25l\ntls:\n  certificate: cert\n"))
+			Expect(readFile("kv/app/db")).To(MatchJSON(`{"password": "one"}`))
+		})
+
+		It("should render template files", func() {
+			tmplDir, err := ioutil.TempDir("", "vault-concourse-template")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmplDir)
+			file := filepath.Join(tmplDir, "db.conf.tmpl")
+			Expect(ioutil.WriteFile(file, []byte(`password={{ secret "/kv/app/db" "password" }}`), 0600)).To(Succeed())
+
+			Expect(in(map[string]interface{}{"file": file, "output": "db.conf"})).To(Succeed())
+			Expect(readFile("db.conf")).To(Equal("password=one"))
+		})
+
+		It("should fail on secrets that were not fetched", func() {
+			err := in(map[string]interface{}{
+				"inline": `{{ secret "kv/app/db" "user" }}`,
+				"output": "out",
+			})
+			Expect(err).To(MatchError(ContainSubstring("Error rendering template")))
+			Expect(err).To(MatchError(ContainSubstring("user")))
+		})
+
+		It("should reject outputs outside the resource directory", func() {
+			err := in(map[string]interface{}{"inline": "x", "output": "../out"})
+			Expect(err).To(MatchError(ContainSubstring("must be below the resource directory")))
+		})
+
+		It("should require either a file or an inline template", func() {
+			err := in(map[string]interface{}{"output": "out"})
+			Expect(err).To(MatchError(ContainSubstring("Exactly one of templates[0].file and templates[0].inline")))
+		})
+	})
+})
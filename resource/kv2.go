@@ -0,0 +1,248 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/cloudfoundry-community/vaultkv"
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// kvVersioned is implemented by the states of KV v2 secrets, which record the
+// KV version they were taken from.
+type kvVersioned interface {
+	kvVersion() uint
+}
+
+// kvMetadata stands in for the value of a KV v2 secret in versions. Every
+// write, delete or undelete changes it, so checks can notice them without
+// reading any secret values.
+type kvMetadata struct {
+	CurrentVersion uint   `json:"current_version"`
+	UpdatedTime    string `json:"updated_time"`
+}
+
+func (m kvMetadata) kvVersion() uint {
+	return m.CurrentVersion
+}
+
+// kvSecret stands in for a KV v2 secret when only some of its keys are
+// selected. Its values are digested, so writes that leave the selected keys
+// alone do not produce a new version.
+type kvSecret struct {
+	*sv.Secret
+	number uint
+}
+
+func (s kvSecret) kvVersion() uint {
+	return s.number
+}
+
+// secretStates returns, for each selected secret under path, what its version
+// digest covers: the metadata of KV v2 secrets when metadata is set, or the
+// values of KV v1 secrets and of KV v2 secrets when only some keys are
+// selected. KV v2 paths without key filters only need list and metadata read
+// permissions.
+func (r *Resource) secretStates(p secretPath, f filter, metadata bool) (map[string]interface{}, error) {
+	mountVersion, err := r.client.MountVersion(p.path)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := r.listSecrets(p, mountVersion)
+	if err != nil {
+		return nil, err
+	}
+	selected := paths[:0]
+	for _, path := range paths {
+		if f.path(path) {
+			selected = append(selected, path)
+		}
+	}
+	if metadata && mountVersion == 2 && !f.filtersKeys() && len(p.keys) == 0 {
+		return r.secretMetadata(selected)
+	}
+	secrets, err := r.readSecrets(selected)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err = p.selectKeys(secrets)
+	if err != nil {
+		return nil, err
+	}
+	secrets = f.secrets(secrets)
+	states := make(map[string]interface{}, len(secrets))
+	for _, s := range secrets {
+		if mountVersion == 2 {
+			states[s.Path] = kvSecret{Secret: s.Versions[0].Data, number: s.Versions[0].Number}
+		} else {
+			states[s.Path] = s.Versions[0].Data
+		}
+	}
+	return states, nil
+}
+
+func (r *Resource) secretMetadata(paths []string) (map[string]interface{}, error) {
+	states := make([]*kvMetadata, len(paths))
+	err := r.forEach(len(paths), func(i int) error {
+		meta, err := r.getMetadata(paths[i])
+		if vaultkv.IsNotFound(err) || vaultkv.IsForbidden(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading metadata of `%s': %s", paths[i], err)
+		}
+		// Like value fetches, skip secrets whose latest version is gone.
+		if !currentVersionAlive(meta) {
+			return nil
+		}
+		states[i] = &kvMetadata{
+			CurrentVersion: meta.CurrentVersion,
+			UpdatedTime:    meta.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(paths))
+	for i, state := range states {
+		if state != nil {
+			result[paths[i]] = *state
+		}
+	}
+	return result, nil
+}
+
+func currentVersionAlive(meta vaultkv.V2Metadata) bool {
+	for _, v := range meta.Versions {
+		if v.Version == meta.CurrentVersion {
+			return versionAlive(v)
+		}
+	}
+	return false
+}
+
+func versionAlive(v vaultkv.V2Version) bool {
+	deleted := v.DeletedAt != nil && !v.DeletedAt.After(time.Now())
+	return !deleted && !v.Destroyed
+}
+
+// versionHistory returns a version for each KV version written to a single
+// KV v2 secret between the last seen version and the current one, oldest
+// first, so pipelines using `version: every` see every rotation. Sources with
+// several secrets, selecting keys, or without a previous version, have no
+// history.
+func (r *Resource) versionHistory(s Source, last, current Version) ([]oc.Version, error) {
+	paths := secretPaths(s.Paths)
+	if len(paths) != 1 || anyKeys(paths) || s.filter.filtersKeys() {
+		return nil, nil
+	}
+	currentKV, err := current.kvVersions()
+	if err != nil {
+		return nil, err
+	}
+	if len(currentKV) != 1 {
+		return nil, nil
+	}
+	lastKV, err := last.kvVersions()
+	if err != nil {
+		return nil, err
+	}
+	var history []oc.Version
+	for path, number := range currentKV {
+		since, ok := lastKV[path]
+		if !ok || number <= since+1 {
+			return nil, nil
+		}
+		meta, err := r.getMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		d := r.versionDigester(s)
+		for _, v := range meta.Versions {
+			if v.Version <= since || v.Version >= number || !versionAlive(v) {
+				continue
+			}
+			version, err := newVersion(map[string]interface{}{
+				path: kvMetadata{
+					CurrentVersion: v.Version,
+					UpdatedTime:    v.CreatedAt.UTC().Format(time.RFC3339Nano),
+				},
+			}, s.URL, d)
+			if err != nil {
+				return nil, err
+			}
+			history = append(history, version.toOCVersion())
+		}
+	}
+	return history, nil
+}
+
+// versionSecrets fetches the secrets under path as they were in a version: the
+// recorded KV version of each KV v2 secret, or the current values of KV v1
+// secrets and of paths the version recorded no KV versions under, such as
+// those added to the source since.
+func (r *Resource) versionSecrets(p secretPath, recorded map[string]uint) (sv.Secrets, error) {
+	mountVersion, err := r.client.MountVersion(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var secrets sv.Secrets
+	if paths := p.recordedPaths(recorded); mountVersion == 2 && len(paths) > 0 {
+		secrets, err = r.recordedSecrets(paths, recorded)
+	} else {
+		var paths []string
+		paths, err = r.listSecrets(p, mountVersion)
+		if err == nil {
+			secrets, err = r.readSecrets(paths)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.selectKeys(secrets)
+}
+
+// recordedPaths returns the recorded paths that path selects.
+func (p secretPath) recordedPaths(recorded map[string]uint) []string {
+	paths := []string{}
+	for path := range recorded {
+		underPath := len(p.keys) == 0 && strings.HasPrefix(path, p.path+"/")
+		if path == p.path || underPath {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (r *Resource) recordedSecrets(paths []string, recorded map[string]uint) (sv.Secrets, error) {
+	secrets := make(sv.Secrets, len(paths))
+	err := r.forEach(len(paths), func(i int) error {
+		path, number := paths[i], recorded[paths[i]]
+		var secret *sv.Secret
+		err := r.limit(func() (err error) {
+			secret, err = r.client.Read(sv.EncodePath(path, "", uint64(number)))
+			return err
+		})
+		if sv.IsNotFound(err) {
+			return fmt.Errorf("Version %d of `%s' has been deleted or destroyed and can no longer be fetched", number, path)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading `%s': %s", path, err)
+		}
+		secrets[i] = sv.SecretEntry{
+			Path:     path,
+			Versions: []sv.SecretVersion{{Data: secret, Number: number}},
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
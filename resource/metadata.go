@@ -0,0 +1,102 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// vaultMetadata names the vault a step talked to.
+func vaultMetadata(s Source) oc.Metadata {
+	metadata := oc.Metadata{{Name: "url", Value: s.URL}}
+	if s.Namespace != "" {
+		metadata = append(metadata, oc.NameVal{Name: "namespace", Value: s.Namespace})
+	}
+	return metadata
+}
+
+// inMetadata describes the secrets In fetched, without their values: how many
+// paths and keys there were, and which KV v2 version of each was read.
+func inMetadata(s Source, secrets sv.Secrets) oc.Metadata {
+	keys := 0
+	versions := []string{}
+	for _, secret := range secrets {
+		keys += len(secret.Versions[0].Data.Keys())
+		if n := secret.Versions[0].Number; n > 0 {
+			versions = append(versions, fmt.Sprintf("%s@%d", secret.Path, n))
+		}
+	}
+	metadata := append(vaultMetadata(s),
+		oc.NameVal{Name: "paths", Value: strconv.Itoa(len(secrets))},
+		oc.NameVal{Name: "keys", Value: strconv.Itoa(keys)},
+	)
+	if len(versions) > 0 {
+		metadata = append(metadata, oc.NameVal{Name: "kv_versions", Value: strings.Join(versions, ", ")})
+	}
+	return metadata
+}
+
+// outMetadata describes what Out wrote, and which of the watched paths changed
+// as a result.
+func outMetadata(s Source, written, changed []string) oc.Metadata {
+	return append(vaultMetadata(s),
+		oc.NameVal{Name: "paths_written", Value: strings.Join(written, ", ")},
+		oc.NameVal{Name: "changed_paths", Value: strings.Join(changed, ", ")},
+	)
+}
+
+// watchedChange reports whether writing secret to path, over existing, which
+// is nil if there was no secret there, changes what check watches. Every
+// write to a KV v2 secret watched through its metadata is a new KV version;
+// otherwise only changes to the watched keys count.
+func (r *Resource) watchedChange(s Source, path string, existing, secret *sv.Secret) bool {
+	if !s.filter.path(path) {
+		return false
+	}
+	path = sv.Canonicalize(path)
+	for _, p := range secretPaths(s.Paths) {
+		watched := sv.Canonicalize(p.path)
+		underPath := len(p.keys) == 0 && strings.HasPrefix(path, watched+"/")
+		if path != watched && !underPath {
+			continue
+		}
+		if existing == nil {
+			return true
+		}
+		mountVersion, err := r.client.MountVersion(path)
+		if err != nil || (mountVersion == 2 && len(p.keys) == 0 && !s.filter.filtersKeys()) {
+			return true
+		}
+		return !sameKeys(watchedKeys(s, p, existing), watchedKeys(s, p, secret))
+	}
+	return false
+}
+
+func watchedKeys(s Source, p secretPath, secret *sv.Secret) *sv.Secret {
+	if len(p.keys) > 0 {
+		selected := sv.NewSecret()
+		for _, key := range p.keys {
+			if secret.Has(key) {
+				selected.Set(key, secret.Get(key), false)
+			}
+		}
+		secret = selected
+	}
+	return s.filter.keys(secret)
+}
+
+func sameKeys(a, b *sv.Secret) bool {
+	if len(a.Keys()) != len(b.Keys()) {
+		return false
+	}
+	for _, key := range a.Keys() {
+		if !b.Has(key) || a.Get(key) != b.Get(key) {
+			return false
+		}
+	}
+	return true
+}
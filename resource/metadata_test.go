@@ -0,0 +1,108 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Metadata", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		dir        string
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	values := func(metadata oc.Metadata) map[string]string {
+		ret := map[string]string{}
+		for _, m := range metadata {
+			ret[m.Name] = m.Value
+		}
+		return ret
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "vault-concourse-metadata")
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Mount("kv", 2)
+		vault.Set("kv/app/db", map[string]string{"password": "one", "user": "app"})
+		vault.Set("kv/app/db", map[string]string{"password": "two", "user": "app"})
+		vault.Set("kv/app/tls", map[string]string{"certificate": "cert"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"kv/app"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should describe what in fetched without values", func() {
+		_, metadata, err := r.In(dir, source, oc.Params{}, oc.Version{}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values(metadata)).To(Equal(map[string]string{
+			"url":         vault.URL,
+			"paths":       "2",
+			"keys":        "3",
+			"kv_versions": "kv/app/db@2, kv/app/tls@1",
+		}))
+	})
+
+	It("should name the namespace", func() {
+		source["namespace"] = "team"
+		_, metadata, err := r.In(dir, source, oc.Params{}, oc.Version{}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values(metadata)).To(HaveKeyWithValue("namespace", "team"))
+	})
+
+	It("should describe what out wrote and changed without values", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "db"), []byte(`{"password": "three"}`), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "new"), []byte(`{"token": "four"}`), 0600)).To(Succeed())
+		_, metadata, err := r.Out(dir, source, oc.Params{"path": ".", "prefix": "kv/app"}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values(metadata)).To(Equal(map[string]string{
+			"url":           vault.URL,
+			"paths_written": "kv/app/db, kv/app/new",
+			"changed_paths": "kv/app/db, kv/app/new",
+		}))
+	})
+
+	It("should only count changes to watched values on KV v1", func() {
+		vault.Set("secret/app/db", map[string]string{"password": "one"})
+		vault.Set("secret/app/tls", map[string]string{"certificate": "cert"})
+		source["paths"] = []string{"secret/app/db", "secret/app/tls"}
+		Expect(ioutil.WriteFile(filepath.Join(dir, "db"), []byte(`{"password": "one"}`), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "tls"), []byte(`{"certificate": "new"}`), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "other"), []byte(`{"token": "new"}`), 0600)).To(Succeed())
+		_, metadata, err := r.Out(dir, source, oc.Params{"path": ".", "prefix": "secret/app"}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values(metadata)).To(HaveKeyWithValue("paths_written", "secret/app/db, secret/app/other, secret/app/tls"))
+		Expect(values(metadata)).To(HaveKeyWithValue("changed_paths", "secret/app/tls"))
+	})
+
+	It("should not walk the watched paths again to report changes", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "db"), []byte(`{"password": "three"}`), 0600)).To(Succeed())
+		_, _, err := r.Out(dir, source, oc.Params{"path": ".", "prefix": "kv/app"}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		lists := 0
+		for _, request := range vault.Requests() {
+			if request == "LIST kv/metadata/app" {
+				lists++
+			}
+		}
+		Expect(lists).To(Equal(1))
+	})
+})
@@ -0,0 +1,74 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// secretPath is a path the resource watches, gathered from the `paths`
+// entries naming it. Entries such as `secret/app/tls:certificate` select
+// keys of a single secret; entries without a key select everything under
+// the path.
+type secretPath struct {
+	path string
+	keys []string
+}
+
+// secretPaths groups the `paths` entries by path, keeping their order.
+func secretPaths(paths []string) []secretPath {
+	ret := []secretPath{}
+	index := map[string]int{}
+	wholePath := map[string]bool{}
+	for _, p := range paths {
+		path, key, _ := sv.ParsePath(p)
+		i, seen := index[path]
+		if !seen {
+			i = len(ret)
+			index[path] = i
+			ret = append(ret, secretPath{path: path})
+		}
+		if key == "" {
+			wholePath[path] = true
+			ret[i].keys = nil
+		} else if !wholePath[path] {
+			ret[i].keys = append(ret[i].keys, key)
+		}
+	}
+	return ret
+}
+
+func anyKeys(paths []secretPath) bool {
+	for _, p := range paths {
+		if len(p.keys) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// selectKeys restricts the secrets to the selected keys, failing if the secret
+// lacks one of them.
+func (p secretPath) selectKeys(secrets sv.Secrets) (sv.Secrets, error) {
+	if len(p.keys) == 0 {
+		return secrets, nil
+	}
+	ret := sv.Secrets{}
+	for _, s := range secrets {
+		if s.Path != p.path {
+			continue
+		}
+		versions := make([]sv.SecretVersion, len(s.Versions))
+		for i, v := range s.Versions {
+			versions[i] = v
+			versions[i].Data = sv.NewSecret()
+			for _, key := range p.keys {
+				if !v.Data.Has(key) {
+					return nil, sv.NewKeyNotFoundError(p.path, key)
+				}
+				versions[i].Data.Set(key, v.Data.Get(key), false)
+			}
+		}
+		ret.Append(sv.SecretEntry{Path: s.Path, Versions: versions})
+	}
+	return ret, nil
+}
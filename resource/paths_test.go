@@ -0,0 +1,86 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Key paths", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		dir        string
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	check := func(version oc.Version) oc.Version {
+		versions, err := r.Check(source, version, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		return versions[len(versions)-1]
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "vault-concourse-keys")
+		Expect(err).ToNot(HaveOccurred())
+		vault = newFakeVault()
+		vault.Mount("kv", 2)
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(dir)
+	})
+
+	for _, mount := range []string{"secret", "kv"} {
+		mount := mount
+
+		Context("on the "+mount+" mount", func() {
+			BeforeEach(func() {
+				vault.Set(mount+"/app/tls", map[string]string{"certificate": "cert", "key": "key", "ca": "ca"})
+				vault.Set(mount+"/app/tls/extra", map[string]string{"other": "other"})
+				source["paths"] = []string{mount + "/app/tls:certificate", mount + "/app/tls:key"}
+			})
+
+			It("should only version the selected keys", func() {
+				source["version_key"] = "pipeline-key"
+				version := check(nil)
+				Expect(version["paths"] + version["kv_versions"]).To(ContainSubstring(mount + "/app/tls"))
+				Expect(version["paths"] + version["kv_versions"]).ToNot(ContainSubstring("extra"))
+
+				vault.Set(mount+"/app/tls", map[string]string{"certificate": "cert", "key": "key", "ca": "new"})
+				Expect(check(version)).To(Equal(version))
+
+				vault.Set(mount+"/app/tls", map[string]string{"certificate": "new", "key": "key", "ca": "new"})
+				Expect(check(version)).ToNot(Equal(version))
+			})
+
+			It("should only fetch the selected keys", func() {
+				version := check(nil)
+				_, _, err := r.In(dir, source, oc.Params{}, version, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+				raw, err := ioutil.ReadFile(filepath.Join(dir, mount, "app/tls"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(raw).To(MatchJSON(`{"certificate": "cert", "key": "key"}`))
+			})
+
+			It("should fail when a selected key is missing", func() {
+				source["paths"] = []string{mount + "/app/tls:missing"}
+				_, err := r.Check(source, nil, env, testLogger)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	}
+})
@@ -0,0 +1,111 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit caps the rate of vault requests with a token bucket refilled at
+// RequestsPerSecond and holding at most Burst requests.
+type RateLimit struct {
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+func (l *RateLimit) validate() error {
+	if l.RequestsPerSecond < 0 {
+		return fmt.Errorf("rate_limit.requests_per_second must be positive")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("rate_limit.burst must be positive")
+	}
+	if l.Burst == 0 {
+		l.Burst = 1
+	}
+	return nil
+}
+
+// rateLimiter spaces out the vault requests of a step according to the
+// source's rate_limit, and holds them all back while vault has asked, with
+// Retry-After, not to be called.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	paused time.Time
+}
+
+func newRateLimiter(l RateLimit) *rateLimiter {
+	return &rateLimiter{
+		rate:   l.RequestsPerSecond,
+		burst:  float64(l.Burst),
+		tokens: float64(l.Burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a request from the bucket and returns how long to wait before
+// making it. It takes nothing and returns false if the wait would run past the
+// deadline.
+func (l *rateLimiter) reserve(deadline time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if l.paused.After(now) {
+		wait = l.paused.Sub(now)
+	}
+	tokens := l.tokens
+	if l.rate > 0 {
+		tokens = math.Min(l.burst, tokens+now.Sub(l.last).Seconds()*l.rate) - 1
+		if tokens < 0 {
+			if d := time.Duration(-tokens / l.rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+	}
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		return 0, false
+	}
+	l.tokens, l.last = tokens, now
+	return wait, true
+}
+
+// pause holds back every request for the given time.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.paused) {
+		l.paused = until
+	}
+}
+
+// retryAfter returns how long a response's Retry-After header, given in
+// seconds or as a date, asks clients to wait.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
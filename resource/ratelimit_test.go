@@ -0,0 +1,88 @@
+package resource_test
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		for i := 0; i < 4; i++ {
+			vault.Set(fmt.Sprintf("secret/app/%d", i), map[string]string{"n": fmt.Sprint(i)})
+		}
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/app"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should space out requests beyond the burst", func() {
+		source["rate_limit"] = map[string]interface{}{
+			"requests_per_second": 50,
+			"burst":               2,
+		}
+		start := time.Now()
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		requests := len(vault.Requests())
+		Expect(requests).To(BeNumerically(">", 2))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Duration(requests-2)*20*time.Millisecond))
+	})
+
+	It("should wait as long as a throttled response asks", func() {
+		source["retry"] = map[string]interface{}{
+			"backoff":      "1ms",
+			"status_codes": []int{http.StatusServiceUnavailable},
+		}
+		vault.RetryAfter = "1"
+		vault.Fail("GET secret/app/0", http.StatusTooManyRequests)
+		start := time.Now()
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("should wait no longer than max_backoff however long a throttled response asks", func() {
+		source["retry"] = map[string]interface{}{"max_backoff": "10ms"}
+		vault.RetryAfter = "3600"
+		vault.Fail("GET secret/app/0", http.StatusTooManyRequests)
+		start := time.Now()
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("should fail when a throttled response asks to wait past the timeout", func() {
+		source["timeout"] = "500ms"
+		vault.RetryAfter = "1"
+		vault.Fail("GET secret/app/0", http.StatusTooManyRequests)
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("Error reading `secret/app/0'")))
+	})
+
+	It("should reject invalid settings", func() {
+		source["rate_limit"] = map[string]interface{}{"requests_per_second": -1}
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("rate_limit.requests_per_second")))
+	})
+})
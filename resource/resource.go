@@ -5,9 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -22,32 +21,102 @@ var (
 	ErrVersion = errors.New(`key "count" not found in version map`)
 	// ErrParam means parameters are malformed
 	ErrParam = errors.New(`missing "version_path" parameter`)
+	// ErrNoPathDigests means a version does not track any path on its own
+	ErrNoPathDigests = errors.New(`version has no per-path digests`)
 )
 
 // Resource implements the ofcourse.Resource interface.
 type Resource struct {
 	client *sv.Vault
+	// ownedToken is a token created by the resource itself, either by logging
+	// in or as a child of the source token, and revoked when the step ends.
+	ownedToken string
+	// parentToken is the token a token_ttl/num_uses child was created from,
+	// kept alive in place of the child.
+	parentToken string
+	// replacedTokens are owned tokens replaced by logging in again, revoked
+	// along with ownedToken when the step ends.
+	replacedTokens []string
+	// requests bounds the vault requests in flight to max_concurrency.
+	requests chan struct{}
+	// transport retries failed vault requests and enforces timeouts.
+	transport *retryTransport
+	// source holds the credentials used to log in again once the token can no
+	// longer be renewed, with any wrapped secret_id already unwrapped.
+	source Source
 }
 
 func (r *Resource) configureClient(s Source) (err error) {
+	r.ownedToken = ""
+	r.parentToken = ""
+	r.replacedTokens = nil
+	r.requests = make(chan struct{}, s.MaxConcurrency)
+	caCerts, err := loadCACerts(s)
+	if err != nil {
+		return err
+	}
 	r.client, err = sv.NewVault(sv.VaultConfig{
 		URL:        s.URL,
-		SkipVerify: true,
+		SkipVerify: s.InsecureSkipVerify,
+		CACerts:    caCerts,
 		Token:      s.Token,
 		Namespace:  s.Namespace,
 	})
 	if err != nil {
 		return err
 	}
-	if s.RoleID != "" {
-		_, err = r.client.Client().Client.AuthApprole(s.RoleID, s.SecretID)
+	// vaultkv installs its redirect policy lazily on the first request, which
+	// races with keepTokenAlive and pins the token sent on redirects.
+	r.client.Client().Client.Client.CheckRedirect = followRedirect
+	err = configureTLS(r.client, s)
+	if err != nil {
+		return err
+	}
+	httpClient := r.client.Client().Client.Client
+	r.transport = newRetryTransport(httpClient.Transport, s.retryPolicy, newRateLimiter(s.RateLimit))
+	httpClient.Transport = r.transport
+	if s.SecretIDWrapped {
+		s.SecretID, err = r.unwrapSecretID(s.SecretID, s.ApproleMount)
 		if err != nil {
 			return err
 		}
+		s.SecretIDWrapped = false
+	}
+	r.source = s
+	return r.authenticate()
+}
+
+// authenticate logs in with the credentials in r.source, if it has any, and
+// applies the token_ttl and num_uses limits.
+func (r *Resource) authenticate() (err error) {
+	s := r.source
+	switch {
+	case s.Auth.Method != "":
+		err = r.login(s.Auth)
+	case s.RoleID != "":
+		err = r.loginAppRole(s)
+	}
+	if err != nil {
+		return err
+	}
+	if s.TokenTTL != "" || s.NumUses > 0 {
+		err = r.limitToken(s.TokenTTL, s.NumUses)
+		if err != nil {
+			r.revokeToken(nil)
+			return err
+		}
 	}
 	return nil
 }
 
+func followRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > 10 {
+		return fmt.Errorf("Stopped after 10 redirects")
+	}
+	req.Header.Set("X-Vault-Token", via[len(via)-1].Header.Get("X-Vault-Token"))
+	return nil
+}
+
 // Check implements the ofcourse.Resource Check method, corresponding to the /opt/resource/check command.
 // This is called when Concourse does its resource checks, or when the `fly check-resource` command is run.
 func (r *Resource) Check(source oc.Source, version oc.Version, env oc.Environment,
@@ -60,44 +129,134 @@ func (r *Resource) Check(source oc.Source, version oc.Version, env oc.Environmen
 	if err != nil {
 		return nil, err
 	}
-	ocVersion, err := r.constructVersion(s, version)
+	defer r.revokeToken(logger)
+	defer r.keepTokenAlive(logger)()
+	if s.VersionKey == "" && s.VersionTransitKey == "" {
+		logger.Warnf("Neither version_key nor version_transit_key is set, versions carry an unkeyed SHA1 of the secrets")
+	}
+	ocVersion, changed, err := r.constructVersion(s, version)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return []oc.Version{version}, nil
+	}
+	if len(version) == 0 {
+		return []oc.Version{ocVersion}, nil
+	}
+	logChangedPaths(version, ocVersion, logger)
+	lastVersion, err := parseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	currentVersion, err := parseVersion(ocVersion)
 	if err != nil {
 		return nil, err
 	}
-	return []oc.Version{ocVersion}, nil
+	history, err := r.versionHistory(s, lastVersion, currentVersion)
+	if err != nil {
+		return nil, err
+	}
+	return append(history, ocVersion), nil
 }
 
-func (r *Resource) constructVersion(s Source, version oc.Version) (oc.Version, error) {
-	secrets := sv.Secrets{}
-	for _, p := range s.Paths {
-		s, err := r.client.ConstructSecrets(p, sv.TreeOpts{
-			FetchKeys: true,
-		})
-		if err != nil {
-			return nil, err
-		}
-		secrets = secrets.Merge(s)
+func logChangedPaths(from, to oc.Version, logger *oc.Logger) {
+	oldVersion, err := parseVersion(from)
+	if err != nil {
+		return
 	}
-	secrets.Sort()
-	export := make(map[string]*sv.Secret)
-	for _, s := range secrets {
-		export[s.Path] = s.Versions[0].Data
+	newVersion, err := parseVersion(to)
+	if err != nil {
+		return
+	}
+	changed, err := changedPaths(oldVersion, newVersion)
+	if err != nil || len(changed) == 0 {
+		return
 	}
-	raw, err := json.Marshal(&export)
+	logger.Infof("Changed paths: %s", strings.Join(changed, ", "))
+}
+
+// constructVersion computes the current version of the source's secrets, and
+// reports whether it differs from version.
+func (r *Resource) constructVersion(s Source, version oc.Version) (oc.Version, bool, error) {
+	export, err := r.sourceStates(s, true)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	current, err := newVersion(export, s.URL, r.versionDigester(s))
+	if err != nil {
+		return nil, false, err
 	}
-	newVersion := newVersion(raw, s.URL)
 	if version != nil {
 		oldVersion, err := parseVersion(version)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		if oldVersion.equal(newVersion) {
-			return oc.Version{}, nil
+		if oldVersion.equal(current) {
+			return version, false, nil
+		}
+		// SHA1 versions, from before a version key was added or from releases
+		// that digested KV v2 values, are kept until the secrets actually
+		// change, rather than retriggering.
+		if oldVersion.legacy() {
+			unchanged, err := r.legacyUnchanged(s, oldVersion, export)
+			if err != nil {
+				return nil, false, err
+			}
+			if unchanged {
+				return version, false, nil
+			}
 		}
 	}
-	return newVersion.toOCVersion(), nil
+	return current.toOCVersion(), true, nil
+}
+
+// sourceStates returns the state of every secret the source watches, keyed by
+// path, as secretStates does.
+func (r *Resource) sourceStates(s Source, metadata bool) (map[string]interface{}, error) {
+	paths := secretPaths(s.Paths)
+	states := make([]map[string]interface{}, len(paths))
+	err := r.forEach(len(paths), func(i int) (err error) {
+		states[i], err = r.secretStates(paths[i], s.filter, metadata)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	export := make(map[string]interface{})
+	for _, pathStates := range states {
+		for path, state := range pathStates {
+			export[path] = state
+		}
+	}
+	return export, nil
+}
+
+// legacyUnchanged reports whether the SHA1 of the secrets still matches a
+// legacy version. Versions without kv_versions were digested over the values
+// of KV v2 secrets rather than their metadata, so those are read once more.
+func (r *Resource) legacyUnchanged(s Source, legacy Version, states map[string]interface{}) (bool, error) {
+	if legacy.KVVersions == "" && hasMetadata(states) {
+		var err error
+		states, err = r.sourceStates(s, false)
+		if err != nil {
+			return false, err
+		}
+	}
+	version, err := newVersion(states, s.URL, legacyDigester)
+	if err != nil {
+		return false, err
+	}
+	return legacy.SecretSHA1 == version.SecretSHA1 && legacy.URL == version.URL, nil
+}
+
+func hasMetadata(states map[string]interface{}) bool {
+	for _, state := range states {
+		if _, ok := state.(kvMetadata); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // In implements the ofcourse.Resource In method, corresponding to the /opt/resource/in command.
@@ -108,48 +267,54 @@ func (r *Resource) In(outputDirectory string, source oc.Source, params oc.Params
 	if err != nil {
 		return nil, nil, err
 	}
+	p, err := parseInParams(params)
+	if err != nil {
+		return nil, nil, err
+	}
 	err = r.configureClient(s)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer r.revokeToken(logger)
+	defer r.keepTokenAlive(logger)()
+	v, err := parseVersion(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	recorded, err := v.kvVersions()
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := secretPaths(s.Paths)
+	pathSecrets := make([]sv.Secrets, len(paths))
+	err = r.forEach(len(paths), func(i int) (err error) {
+		pathSecrets[i], err = r.versionSecrets(paths[i], recorded)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 	secrets := sv.Secrets{}
-	for _, p := range s.Paths {
-		s, err := r.client.ConstructSecrets(p, sv.TreeOpts{
-			FetchKeys: true,
-		})
-		if err != nil {
-			return nil, nil, err
-		}
+	for _, s := range pathSecrets {
 		secrets = secrets.Merge(s)
 	}
+	secrets = s.filter.secrets(secrets)
 	secrets.Sort()
-	for _, s := range secrets {
-		filePath := filepath.Join(outputDirectory, s.Path)
-		raw, err := s.Versions[0].Data.MarshalJSON()
-		if err != nil {
-			return nil, nil, err
-		}
-		err = os.MkdirAll(path.Dir(filePath), 0775)
-		if err != nil {
-			return nil, nil, err
-		}
-		err = ioutil.WriteFile(filePath, raw, 0644)
-		if err != nil {
-			return nil, nil, err
-		}
+	w, err := p.fileWriter(outputDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = p.writeSecrets(w, secrets)
+	if err == nil {
+		err = renderTemplates(w, p.Templates, secrets)
 	}
-	// Metadata consists of arbitrary name/value pairs for display in the Concourse UI,
-	// and may be returned empty if not needed.
-	metadata := oc.Metadata{
-		// {
-		// 	Name:  "a",
-		// 	Value: "b",
-		// },
-		// {
-		// 	Name:  "c",
-		// 	Value: "d",
-		// },
+	if closeErr := w.close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := inMetadata(s, secrets)
 	// Here, `version` is passed through from the argument. In most cases, it makes sense
 	// to retrieve the most recent version, i.e. the one in the `version` argument, and
 	// then return it back unchanged. However, it is allowed to return some other version
@@ -174,6 +339,8 @@ func (r *Resource) Out(inputDirectory string, source oc.Source, params oc.Params
 	if err != nil {
 		return nil, nil, err
 	}
+	defer r.revokeToken(logger)
+	defer r.keepTokenAlive(logger)()
 
 	rootDir := filepath.Join(inputDirectory, p.Path)
 
@@ -188,6 +355,8 @@ func (r *Resource) Out(inputDirectory string, source oc.Source, params oc.Params
 		}
 	}
 
+	written, changed := []string{}, []string{}
+
 	for _, secretMap := range p.SecretMaps {
 		if secretMap.Dest == "" {
 			secretMap.Dest = secretMap.Source
@@ -216,21 +385,30 @@ func (r *Resource) Out(inputDirectory string, source oc.Source, params oc.Params
 		}
 
 		finalVaultPath := filepath.Join(p.Prefix, secretMap.Dest)
-		retainExistingKeys(r.client, finalVaultPath, secretToWrite)
+		if !s.filter.path(finalVaultPath) {
+			logger.Infof("Skipping `%s', it is not selected by include/exclude", finalVaultPath)
+			continue
+		}
+		secretToWrite = s.filter.keys(secretToWrite)
+		existing := retainExistingKeys(r.client, finalVaultPath, secretToWrite)
 
 		err = copySecretToVault(r.client, finalVaultPath, secretToWrite)
 		if err != nil {
 			return nil, nil, err
 		}
+		written = append(written, finalVaultPath)
+		if r.watchedChange(s, finalVaultPath, existing, secretToWrite) {
+			changed = append(changed, finalVaultPath)
+		}
 
 	}
 	// Both `version` and `metadata` may be empty. In this case, we are returning
 	// `version` just as we do from `Check`, while `metadata` is empty.
-	ocVersion, err := r.constructVersion(s, nil)
+	ocVersion, _, err := r.constructVersion(s, nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	metadata := oc.Metadata{}
+	metadata := outMetadata(s, written, changed)
 	return ocVersion, metadata, nil
 }
 
@@ -346,18 +524,26 @@ func filterAndRenameKeys(secret *sv.Secret, finalKeys map[string]string) *sv.Sec
 }
 
 func copySecretToVault(client *sv.Vault, finalVaultPath string, newSecret *sv.Secret) error {
-	return client.Write(finalVaultPath, newSecret)
+	err := client.Write(finalVaultPath, newSecret)
+	if err != nil {
+		return fmt.Errorf("Error writing `%s': %s", finalVaultPath, err)
+	}
+	return nil
 }
 
-func retainExistingKeys(client *sv.Vault, finalVaultPath string, newSecret *sv.Secret) {
+// retainExistingKeys adds the keys of the secret already at finalVaultPath to
+// newSecret, and returns that secret, or nil if there is none.
+func retainExistingKeys(client *sv.Vault, finalVaultPath string, newSecret *sv.Secret) *sv.Secret {
 	existingSecret, err := client.Read(finalVaultPath)
-	if err == nil {
-		for _, existingKey := range existingSecret.Keys() {
-			if !newSecret.Has(existingKey) {
-				newSecret.Set(existingKey, existingSecret.Get(existingKey), false)
-			}
+	if err != nil {
+		return nil
+	}
+	for _, existingKey := range existingSecret.Keys() {
+		if !newSecret.Has(existingKey) {
+			newSecret.Set(existingKey, existingSecret.Get(existingKey), false)
 		}
 	}
+	return existingSecret
 }
 
 func getFinalKeys(keys []interface{}) (map[string]string, error) {
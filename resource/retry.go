@@ -0,0 +1,314 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the retry policy and timeouts left unset in the source.
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultRetryMaxBackoff = 10 * time.Second
+	defaultRetryJitter     = 0.2
+	defaultRequestTimeout  = time.Minute
+)
+
+var defaultRetryStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryPolicy is the parsed form of the source's retry, request_timeout and
+// timeout settings.
+type retryPolicy struct {
+	attempts       int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	statusCodes    map[int]bool
+	requestTimeout time.Duration
+	timeout        time.Duration
+}
+
+func (s *Source) parseRetryPolicy() error {
+	p := retryPolicy{
+		attempts:    s.Retry.Attempts,
+		jitter:      defaultRetryJitter,
+		statusCodes: map[int]bool{},
+	}
+	if p.attempts < 0 {
+		return fmt.Errorf("retry.attempts must be positive")
+	}
+	if p.attempts == 0 {
+		p.attempts = defaultRetryAttempts
+	}
+	var err error
+	if p.backoff, err = parseDuration("retry.backoff", s.Retry.Backoff, defaultRetryBackoff); err != nil {
+		return err
+	}
+	if p.maxBackoff, err = parseDuration("retry.max_backoff", s.Retry.MaxBackoff, defaultRetryMaxBackoff); err != nil {
+		return err
+	}
+	if s.Retry.Jitter != nil {
+		p.jitter = *s.Retry.Jitter
+	}
+	if p.jitter < 0 || p.jitter > 1 {
+		return fmt.Errorf("retry.jitter must be between 0 and 1")
+	}
+	codes := s.Retry.StatusCodes
+	if len(codes) == 0 {
+		codes = defaultRetryStatusCodes
+	}
+	for _, code := range codes {
+		p.statusCodes[code] = true
+	}
+	if p.requestTimeout, err = parseDuration("request_timeout", s.RequestTimeout, defaultRequestTimeout); err != nil {
+		return err
+	}
+	if p.timeout, err = parseDuration("timeout", s.Timeout, 0); err != nil {
+		return err
+	}
+	s.retryPolicy = p
+	return nil
+}
+
+func parseDuration(field, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s `%s': %s", field, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive", field)
+	}
+	return d, nil
+}
+
+// wait returns how long to back off before the given retry, doubling each
+// time up to maxBackoff, spread by jitter so clients do not retry in step.
+func (p retryPolicy) wait(retry int) time.Duration {
+	wait := float64(p.backoff) * math.Pow(2, float64(retry-1))
+	if wait > float64(p.maxBackoff) {
+		wait = float64(p.maxBackoff)
+	}
+	wait += wait * p.jitter * (2*rand.Float64() - 1)
+	return time.Duration(wait)
+}
+
+// timeoutError is returned when a request runs out of time.
+type timeoutError struct {
+	setting string
+	limit   time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s of %s exceeded", e.setting, e.limit)
+}
+
+// retryTransport retries vault requests that fail with a network error or a
+// retryable status code, and bounds each attempt by request_timeout and the
+// whole step by timeout. Every attempt first waits its turn with the limiter.
+type retryTransport struct {
+	next    http.RoundTripper
+	policy  retryPolicy
+	limiter *rateLimiter
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newRetryTransport(next http.RoundTripper, policy retryPolicy, limiter *rateLimiter) *retryTransport {
+	t := &retryTransport{next: next, policy: policy, limiter: limiter}
+	if policy.timeout > 0 {
+		t.deadline = time.Now().Add(policy.timeout)
+	}
+	return t
+}
+
+// liftDeadline lets requests made after the step, such as revoking its token,
+// run past the step's timeout.
+func (t *retryTransport) liftDeadline() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deadline = time.Time{}
+}
+
+func (t *retryTransport) stepDeadline() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deadline
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline := t.stepDeadline()
+	for attempt := 1; ; attempt++ {
+		wait, ok := t.limiter.reserve(deadline)
+		if !ok {
+			return nil, timeoutError{"timeout", t.policy.timeout}
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		resp, written, err := t.attempt(req, deadline)
+		after, throttled := retryAfter(resp)
+		if throttled {
+			// A Retry-After is honoured up to max_backoff, so a misbehaving
+			// proxy cannot stall the step for hours.
+			if after > t.policy.maxBackoff {
+				after = t.policy.maxBackoff
+			}
+			t.limiter.pause(after)
+		}
+		if !t.retryable(req, resp, written, err) || attempt >= t.policy.attempts {
+			return resp, err
+		}
+		wait = t.policy.wait(attempt)
+		if throttled {
+			wait = after
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// attempt sends req once, and reports whether the request was written out in
+// full, after which vault may have acted on it even if no response came back.
+func (t *retryTransport) attempt(req *http.Request, deadline time.Time) (*http.Response, bool, error) {
+	limit := timeoutError{"request_timeout", t.policy.requestTimeout}
+	until := time.Now().Add(t.policy.requestTimeout)
+	if !deadline.IsZero() && deadline.Before(until) {
+		limit = timeoutError{"timeout", t.policy.timeout}
+		until = deadline
+	}
+	var written int32
+	ctx, cancel := context.WithDeadline(req.Context(), until)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(&written, 1)
+			}
+		},
+	})
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, atomic.LoadInt32(&written) == 1, limit
+		}
+		return nil, atomic.LoadInt32(&written) == 1, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, true, nil
+}
+
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, written bool, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	// Sending these twice is not harmless, so they are only retried when
+	// vault cannot have acted on them: when the request never reached it, or
+	// when a rate limit quota turned it away.
+	if unrepeatable(req) {
+		if err != nil {
+			return !written && !isStepTimeout(err) && !certificateError(err)
+		}
+		return resp.StatusCode == http.StatusTooManyRequests
+	}
+	if err != nil {
+		if isStepTimeout(err) {
+			return false
+		}
+		if _, ok := err.(timeoutError); ok {
+			return true
+		}
+		return !certificateError(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || t.policy.statusCodes[resp.StatusCode]
+}
+
+func isStepTimeout(err error) bool {
+	limit, ok := err.(timeoutError)
+	return ok && limit.setting == "timeout"
+}
+
+// unrepeatable reports whether req is a vault request that must not be sent
+// twice: unwrapping a single use wrapping token, whose secret would be lost
+// along with a lost response, or logging in and creating tokens, which would
+// leave a token behind that is never revoked.
+func unrepeatable(req *http.Request) bool {
+	path := req.URL.Path
+	if i := strings.Index(path, "/v1/"); i >= 0 {
+		path = path[i+len("/v1/"):]
+	}
+	return path == "sys/wrapping/unwrap" ||
+		strings.HasPrefix(path, "auth/token/create") ||
+		(strings.HasPrefix(path, "auth/") && strings.Contains(path, "/login"))
+}
+
+// certificateError reports whether err is a TLS certificate failure on either
+// side of the connection, which retrying cannot fix.
+func certificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid) || strings.Contains(err.Error(), "remote error: tls:")
+}
+
+// cancelOnClose releases a request's context once its response is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,176 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Retries", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	countRequests := func(request string) int {
+		n := 0
+		for _, req := range vault.Requests() {
+			if req == request {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		vault.Set("secret/app/db", map[string]string{"password": "one"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/app"},
+			"retry": map[string]interface{}{
+				"backoff": "1ms",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should retry requests that fail with a retryable status", func() {
+		vault.Fail("GET secret/app/db", http.StatusServiceUnavailable, http.StatusBadGateway)
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(countRequests("GET secret/app/db")).To(Equal(3))
+	})
+
+	It("should not retry other statuses", func() {
+		vault.Fail("GET secret/app/db", http.StatusBadRequest)
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("Error reading `secret/app/db'")))
+		Expect(countRequests("GET secret/app/db")).To(Equal(1))
+	})
+
+	It("should retry the configured status codes", func() {
+		source["retry"] = map[string]interface{}{
+			"backoff":      "1ms",
+			"status_codes": []int{http.StatusBadRequest},
+		}
+		vault.Fail("GET secret/app/db", http.StatusBadRequest)
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(countRequests("GET secret/app/db")).To(Equal(2))
+	})
+
+	It("should give up after the configured attempts", func() {
+		source["retry"] = map[string]interface{}{
+			"attempts": 2,
+			"backoff":  "1ms",
+		}
+		vault.Fail("GET secret/app/db", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("Error reading `secret/app/db'")))
+		Expect(countRequests("GET secret/app/db")).To(Equal(2))
+	})
+
+	It("should retry failed writes", func() {
+		dir, err := ioutil.TempDir("", "vault-concourse-retry")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "db"), []byte(`{"password": "two"}`), 0600)).To(Succeed())
+		vault.Fail("PUT secret/app/db", http.StatusServiceUnavailable)
+
+		_, _, err = r.Out(dir, source, oc.Params{"path": ".", "prefix": "secret/app"}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(countRequests("PUT secret/app/db")).To(Equal(2))
+		Expect(vault.Get("secret/app/db")).To(Equal(map[string]string{"password": "two"}))
+	})
+
+	Describe("requests that must not be sent twice", func() {
+		BeforeEach(func() {
+			delete(source, "token")
+			source["role_id"] = "role"
+			source["secret_id"] = "secret"
+			vault.Handle("auth/approle/login", loginHandler(vault, nil))
+		})
+
+		It("should not retry a failed login", func() {
+			vault.Fail("POST auth/approle/login", http.StatusBadGateway)
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(HaveOccurred())
+			Expect(countRequests("POST auth/approle/login")).To(Equal(1))
+		})
+
+		It("should retry a login turned away by a rate limit quota", func() {
+			vault.Fail("POST auth/approle/login", http.StatusTooManyRequests)
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(countRequests("POST auth/approle/login")).To(Equal(2))
+		})
+
+		It("should not retry a failed token create", func() {
+			source["token_ttl"] = "5m"
+			vault.Fail("POST auth/token/create", http.StatusServiceUnavailable)
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(HaveOccurred())
+			Expect(countRequests("POST auth/token/create")).To(Equal(1))
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should not retry a failed unwrap", func() {
+			source["secret_id"] = "wrapping-token"
+			source["secret_id_wrapped"] = true
+			vault.Handle("sys/wrapping/lookup", func(w http.ResponseWriter, req *http.Request) {
+				writeFakeJSON(w, map[string]interface{}{
+					"data": map[string]interface{}{"creation_path": "auth/approle/role/ci/secret-id"},
+				})
+			})
+			vault.Fail("POST sys/wrapping/unwrap", http.StatusBadGateway)
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(HaveOccurred())
+			Expect(countRequests("POST sys/wrapping/unwrap")).To(Equal(1))
+		})
+	})
+
+	It("should time out slow requests, naming the path", func() {
+		vault.Delay = 200 * time.Millisecond
+		source["request_timeout"] = "50ms"
+		source["retry"] = map[string]interface{}{
+			"attempts": 1,
+		}
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("`secret/app")))
+		Expect(err).To(MatchError(ContainSubstring("request_timeout of 50ms exceeded")))
+	})
+
+	It("should stop retrying once the step times out", func() {
+		vault.Delay = 100 * time.Millisecond
+		source["timeout"] = "150ms"
+		source["max_concurrency"] = 1
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("timeout of 150ms exceeded")))
+	})
+
+	It("should reject invalid settings", func() {
+		source["request_timeout"] = "soon"
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("Invalid request_timeout `soon'")))
+
+		delete(source, "request_timeout")
+		source["retry"] = map[string]interface{}{"jitter": 2}
+		_, err = r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("retry.jitter")))
+	})
+})
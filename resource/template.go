@@ -0,0 +1,93 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	sv "github.com/starkandwayne/safe/vault"
+	"gopkg.in/yaml.v2"
+)
+
+// Template is a Go text/template rendered by In against the fetched secrets,
+// read from File or given Inline, and written to Output below the directory In
+// writes to.
+type Template struct {
+	File   string `mapstructure:"file"`
+	Inline string `mapstructure:"inline"`
+	Output string `mapstructure:"output"`
+}
+
+func (t Template) validate(i int) error {
+	if (t.File == "") == (t.Inline == "") {
+		return fmt.Errorf("Exactly one of templates[%d].file and templates[%d].inline must be set", i, i)
+	}
+	if t.Output == "" {
+		return fmt.Errorf("Missing templates[%d].output field", i)
+	}
+	output := filepath.Clean(t.Output)
+	if filepath.IsAbs(output) || output == ".." || strings.HasPrefix(output, "../") {
+		return fmt.Errorf("templates[%d].output `%s' must be below the resource directory", i, t.Output)
+	}
+	return nil
+}
+
+// renderTemplates renders each template against the secrets, keyed by path and
+// then by key, and writes it with w.
+func renderTemplates(w *fileWriter, templates []Template, secrets sv.Secrets) error {
+	tree := map[string]map[string]string{}
+	for _, s := range secrets {
+		tree[s.Path] = secretData(s.Versions[0].Data)
+	}
+	funcs := template.FuncMap{
+		"secret": func(path, key string) (string, error) {
+			data, ok := tree[sv.Canonicalize(path)]
+			if !ok {
+				return "", fmt.Errorf("`%s' was not fetched", path)
+			}
+			value, ok := data[key]
+			if !ok {
+				return "", sv.NewKeyNotFoundError(path, key)
+			}
+			return value, nil
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"indent": func(spaces int, s string) string {
+			pad := strings.Repeat(" ", spaces)
+			return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			raw, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(raw), "\n"), err
+		},
+	}
+	for _, t := range templates {
+		name, text := "inline template for "+t.Output, t.Inline
+		if t.File != "" {
+			raw, err := ioutil.ReadFile(t.File)
+			if err != nil {
+				return fmt.Errorf("Error reading template: %s", err)
+			}
+			name, text = t.File, string(raw)
+		}
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("Error parsing template: %s", err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, tree); err != nil {
+			return fmt.Errorf("Error rendering template: %s", err)
+		}
+		if err := w.write(t.Output, out.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// loadCACerts returns the pool of CAs trusted for the Vault server certificate.
+// When neither ca_cert nor ca_path is given, nil is returned so that the
+// system roots are used.
+func loadCACerts(s Source) (*x509.CertPool, error) {
+	if s.CaCert == "" && s.CaPath == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if s.CaCert != "" {
+		if !pool.AppendCertsFromPEM([]byte(s.CaCert)) {
+			return nil, fmt.Errorf("No valid PEM certificates found in ca_cert")
+		}
+	}
+	if s.CaPath != "" {
+		files, err := caFiles(s.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading CA file '%s': %s", file, err)
+			}
+			if !pool.AppendCertsFromPEM(raw) {
+				return nil, fmt.Errorf("No valid PEM certificates found in '%s'", file)
+			}
+		}
+	}
+	return pool, nil
+}
+
+// caFiles returns the files making up the CA bundle at caPath, which may be
+// either a single file or a directory of files.
+func caFiles(caPath string) ([]string, error) {
+	info, err := os.Stat(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading ca_path '%s': %s", caPath, err)
+	}
+	if !info.IsDir() {
+		return []string{caPath}, nil
+	}
+	entries, err := ioutil.ReadDir(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading ca_path '%s': %s", caPath, err)
+	}
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		files = append(files, filepath.Join(caPath, entry.Name()))
+	}
+	return files, nil
+}
+
+// configureTLS applies the TLS settings which safe's VaultConfig does not
+// expose, namely the expected server name and the client certificate.
+func configureTLS(client *sv.Vault, s Source) error {
+	if s.TLSServerName == "" && s.ClientCert == "" {
+		return nil
+	}
+	transport, ok := client.Client().Client.Client.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return fmt.Errorf("Unable to configure TLS for the vault client")
+	}
+	transport.TLSClientConfig.ServerName = s.TLSServerName
+	if s.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(s.ClientCert), []byte(s.ClientKey))
+		if err != nil {
+			return fmt.Errorf("Error loading client_cert and client_key: %s", err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package resource_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+func generateClientCert() (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "concourse"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		caCert     string
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		vault = newUnstartedFakeVault()
+		vault.Set("secret/handshake", map[string]string{"knock": "knock"})
+	})
+
+	JustBeforeEach(func() {
+		vault.StartTLS()
+		caCert = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: vault.Certificate().Raw,
+		}))
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/handshake"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should refuse an untrusted server certificate by default", func() {
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should trust the server when ca_cert is given", func() {
+		source["ca_cert"] = caCert
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should trust the server when ca_path points at a bundle", func() {
+		dir, err := ioutil.TempDir("", "vault-concourse-ca")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte(caCert), 0600)).To(Succeed())
+
+		source["ca_path"] = dir
+		_, err = r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should skip verification only when insecure_skip_verify is set", func() {
+		source["insecure_skip_verify"] = true
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should verify against tls_server_name", func() {
+		source["ca_cert"] = caCert
+		source["tls_server_name"] = "vault.invalid"
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(HaveOccurred())
+
+		source["tls_server_name"] = "example.com"
+		_, err = r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject a client_cert without a client_key", func() {
+		source["ca_cert"] = caCert
+		source["client_cert"] = "cert"
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("client_key")))
+	})
+
+	Context("when the server requires a client certificate", func() {
+		var clientCert, clientKey string
+
+		BeforeEach(func() {
+			clientCert, clientKey = generateClientCert()
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM([]byte(clientCert))
+			vault.TLS = &tls.Config{
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				ClientCAs:  pool,
+			}
+		})
+
+		It("should fail without a client certificate", func() {
+			source["ca_cert"] = caCert
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should present client_cert and client_key", func() {
+			source["ca_cert"] = caCert
+			source["client_cert"] = clientCert
+			source["client_key"] = clientKey
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should log in via the cert auth method", func() {
+			var presented []string
+			vault.Handle("auth/cert/login", func(w http.ResponseWriter, req *http.Request) {
+				for _, cert := range req.TLS.PeerCertificates {
+					presented = append(presented, cert.Subject.CommonName)
+				}
+				loginHandler(vault, map[string]interface{}{"name": "ci"})(w, req)
+			})
+			source["ca_cert"] = caCert
+			source["client_cert"] = clientCert
+			source["client_key"] = clientKey
+			source["auth"] = map[string]interface{}{
+				"method": "cert",
+				"role":   "ci",
+			}
+			delete(source, "token")
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(presented).To(Equal([]string{"concourse"}))
+		})
+
+		It("should require a client certificate for the cert auth method", func() {
+			source["ca_cert"] = caCert
+			source["auth"] = map[string]interface{}{"method": "cert"}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(MatchError(ContainSubstring("client_cert")))
+		})
+	})
+})
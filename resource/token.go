@@ -0,0 +1,162 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+// minRenewWait bounds how often keepTokenAlive talks to vault.
+const minRenewWait = time.Second
+
+// limitToken swaps the client's token for a child token limited to ttl and
+// numUses, so a token leaked by a step that never reaches revokeToken is
+// short lived. When the resource logged in itself, revoking the login token
+// also revokes the child; otherwise the child is the token to revoke.
+func (r *Resource) limitToken(ttl string, numUses int) error {
+	payload := map[string]interface{}{}
+	if ttl != "" {
+		payload["ttl"] = ttl
+	}
+	if numUses > 0 {
+		payload["num_uses"] = numUses
+	}
+	var result authResponse
+	err := r.post("auth/token/create", payload, &result)
+	if err != nil {
+		return fmt.Errorf("Error creating token limited by token_ttl/num_uses: %s", err)
+	}
+	r.parentToken = r.client.Client().Client.AuthToken
+	r.client.Client().Client.SetAuthToken(result.Auth.ClientToken)
+	if r.ownedToken == "" {
+		r.ownedToken = result.Auth.ClientToken
+	}
+	return nil
+}
+
+// revokeToken revokes the tokens created by the resource, if any, including
+// those replaced by logging in again. Failures are only logged since the
+// step's own result matters more than the cleanup.
+func (r *Resource) revokeToken(logger *oc.Logger) {
+	tokens := r.replacedTokens
+	if r.ownedToken != "" {
+		tokens = append(tokens, r.ownedToken)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+	r.transport.liftDeadline()
+	r.ownedToken = ""
+	r.replacedTokens = nil
+	for _, token := range tokens {
+		r.client.Client().Client.SetAuthToken(token)
+		err := r.post("auth/token/revoke-self", nil, nil)
+		if err != nil && logger != nil {
+			logger.Warnf("Unable to revoke vault token: %s", err)
+		}
+	}
+}
+
+// keepTokenAlive renews the client token in the background until the returned
+// function is called, so long running steps outlive short token TTLs. Once the
+// token can no longer be renewed, it logs in again if the source has
+// credentials to do so. The replaced token is revoked when the step ends
+// rather than straight away, as requests in flight may still be using it.
+//
+// When the client token is a token_ttl/num_uses child, its parent is renewed
+// instead: the child is limited on purpose and, like any vault token, dies
+// with its parent, while renewing it would spend its uses.
+func (r *Resource) keepTokenAlive(logger *oc.Logger) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			client := r.renewedClient()
+			info, err := client.TokenInfoSelf()
+			if err != nil {
+				logger.Warnf("Unable to look up vault token, it will not be renewed: %s", err)
+				return
+			}
+			if info.TTL == 0 {
+				return
+			}
+			wait := info.TTL * 2 / 3
+			if wait < minRenewWait {
+				wait = minRenewWait
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+			if info.Renewable {
+				var result authResponse
+				err = renewSelf(client, &result)
+				remaining := time.Duration(result.Auth.LeaseDuration) * time.Second
+				if err == nil && remaining > info.TTL-wait {
+					logger.Debugf("Renewed vault token for %s", remaining)
+					continue
+				}
+			}
+			if !r.canLogin() {
+				logger.Warnf("Vault token can no longer be renewed and will expire")
+				return
+			}
+			logger.Debugf("Vault token can no longer be renewed, logging in again")
+			replaced := r.ownedToken
+			err = r.authenticate()
+			if err != nil {
+				logger.Warnf("Unable to log in to vault again: %s", err)
+				return
+			}
+			if replaced != "" {
+				r.replacedTokens = append(r.replacedTokens, replaced)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func (r *Resource) canLogin() bool {
+	return r.source.Auth.Method != "" || r.source.RoleID != ""
+}
+
+// renewedClient returns a client for the token keepTokenAlive renews: the
+// parent of a token_ttl/num_uses child if there is one, otherwise the client
+// token. It shares the resource's HTTP client, and so its retries and limits.
+func (r *Resource) renewedClient() *vaultkv.Client {
+	c := r.client.Client().Client
+	token := r.parentToken
+	if token == "" {
+		token = c.AuthToken
+	}
+	return &vaultkv.Client{
+		AuthToken: token,
+		VaultURL:  c.VaultURL,
+		Client:    c.Client,
+		Trace:     c.Trace,
+		Namespace: c.Namespace,
+	}
+}
+
+// renewSelf renews the token of client and decodes the response into result.
+// vaultkv's TokenRenewSelf does not return the new lease duration.
+func renewSelf(client *vaultkv.Client, result *authResponse) error {
+	resp, err := client.Curl("POST", "auth/token/renew-self", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("auth/token/renew-self returned %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,156 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Token", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		vault.Set("secret/handshake", map[string]string{"knock": "knock"})
+		vault.Handle("auth/approle/login", loginHandler(vault, nil))
+		source = oc.Source{
+			"url":       vault.URL,
+			"role_id":   "role",
+			"secret_id": "secret",
+			"paths":     []string{"secret/handshake"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	Describe("revocation", func() {
+		It("should revoke the login token after Check", func() {
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vault.Requests()).To(ContainElement("POST auth/token/revoke-self"))
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should revoke the login token after In", func() {
+			outDir, err := ioutil.TempDir("", "vault-concourse-in")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(outDir)
+			_, _, err = r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should revoke the login token when the step fails", func() {
+			source["paths"] = []string{"secret/missing"}
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).To(HaveOccurred())
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should leave a static source token alone", func() {
+			delete(source, "role_id")
+			delete(source, "secret_id")
+			source["token"] = vault.Token
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vault.Requests()).ToNot(ContainElement("POST auth/token/revoke-self"))
+		})
+	})
+
+	Describe("token_ttl and num_uses", func() {
+		It("should run the step with a limited child token and revoke it", func() {
+			source["token_ttl"] = "5m"
+			source["num_uses"] = 50
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vault.Requests()).To(ContainElement("POST auth/token/create"))
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should revoke a child of a static source token but not the token itself", func() {
+			delete(source, "role_id")
+			delete(source, "secret_id")
+			source["token"] = vault.Token
+			source["token_ttl"] = "5m"
+			_, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vault.Requests()).To(ContainElement("POST auth/token/create"))
+			Expect(vault.LiveTokens()).To(Equal(0))
+			Expect(vault.ValidToken(vault.Token)).To(BeTrue())
+		})
+	})
+
+	Describe("renewal", func() {
+		var outDir string
+
+		countRequests := func(request string) int {
+			count := 0
+			for _, r := range vault.Requests() {
+				if r == request {
+					count++
+				}
+			}
+			return count
+		}
+
+		BeforeEach(func() {
+			var err error
+			outDir, err = ioutil.TempDir("", "vault-concourse-in")
+			Expect(err).ToNot(HaveOccurred())
+			vault.Set("secret/tree/a", map[string]string{"a": "1"})
+			vault.Set("secret/tree/b", map[string]string{"b": "2"})
+			source["paths"] = []string{"secret/tree"}
+			source["max_concurrency"] = 1
+			vault.TokenTTL = 2 * time.Second
+			vault.Delay = 400 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outDir)
+		})
+
+		It("should renew a short lived token while In runs", func() {
+			_, _, err := r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(countRequests("POST auth/token/renew-self")).To(BeNumerically(">=", 1))
+			Expect(countRequests("POST auth/approle/login")).To(Equal(1))
+		})
+
+		It("should log in again once the token cannot be renewed", func() {
+			vault.TokenRenewable = false
+			_, _, err := r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(countRequests("POST auth/approle/login")).To(BeNumerically(">=", 2))
+			Expect(vault.LiveTokens()).To(Equal(0))
+		})
+
+		It("should keep the login token alive along with its token_ttl child", func() {
+			source["token_ttl"] = "1m"
+			vault.Set("secret/tree/c", map[string]string{"c": "3"})
+			_, _, err := r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(countRequests("POST auth/token/renew-self")).To(BeNumerically(">=", 1))
+			Expect(countRequests("POST auth/approle/login")).To(Equal(1))
+		})
+
+		It("should not spend the uses of a num_uses child on renewal", func() {
+			source["num_uses"] = 3
+			_, _, err := r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(countRequests("POST auth/token/renew-self")).To(BeNumerically(">=", 1))
+		})
+	})
+})
@@ -2,12 +2,44 @@
 package resource
 
 import (
-	"crypto/sha1"
+	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
 	oc "github.com/cloudboss/ofcourse/ofcourse"
 	"github.com/mitchellh/mapstructure"
 )
 
+// pathDigestLength is how many hex characters of each per-path digest are kept
+// in the version, enough to tell changes apart while keeping versions small.
+const pathDigestLength = 16
+
+// maxPathDigests bounds how many per-path digests and KV versions a version
+// carries, since Concourse stores every version. Larger trees only get the
+// overall digest.
+const maxPathDigests = 200
+
+// InParams configures how In writes the secrets it fetches.
+type InParams struct {
+	Format     string     `mapstructure:"format"`
+	SingleFile bool       `mapstructure:"single_file"`
+	Templates  []Template `mapstructure:"templates"`
+	// FileMode and DirMode are octal permissions, such as "0600".
+	FileMode string `mapstructure:"file_mode"`
+	DirMode  string `mapstructure:"dir_mode"`
+	// Owner is the user, and optionally the group, to give the files to, as
+	// names or IDs such as "1000:1000".
+	Owner   string  `mapstructure:"owner"`
+	Encrypt Encrypt `mapstructure:"encrypt"`
+
+	fileMode, dirMode os.FileMode
+	uid, gid          int
+	encrypter         *encrypter
+}
+
 // Recursively read all files from path and write to vault
 type OutParams struct {
 	Path       string      `mapstructure:"path"`
@@ -22,17 +54,75 @@ type SecretMap struct {
 }
 
 type Source struct {
-	URL       string   `mapstructure:"url"`
-	Token     string   `mapstructure:"token"`
-	RoleID    string   `mapstructure:"role_id"`
-	SecretID  string   `mapstructure:"secret_id"`
-	CaCert    string   `mapstructure:"ca_cert,omitempty"`
-	Namespace string   `mapstructure:"namespace"`
-	Paths     []string `mapstructure:"paths"`
+	URL                string   `mapstructure:"url"`
+	Token              string   `mapstructure:"token"`
+	RoleID             string   `mapstructure:"role_id"`
+	SecretID           string   `mapstructure:"secret_id"`
+	SecretIDWrapped    bool     `mapstructure:"secret_id_wrapped"`
+	ApproleMount       string   `mapstructure:"approle_mount"`
+	CaCert             string   `mapstructure:"ca_cert,omitempty"`
+	CaPath             string   `mapstructure:"ca_path"`
+	TLSServerName      string   `mapstructure:"tls_server_name"`
+	InsecureSkipVerify bool     `mapstructure:"insecure_skip_verify"`
+	ClientCert         string   `mapstructure:"client_cert"`
+	ClientKey          string   `mapstructure:"client_key"`
+	Namespace          string   `mapstructure:"namespace"`
+	Paths              []string `mapstructure:"paths"`
+	Auth               Auth     `mapstructure:"auth"`
+	TokenTTL           string   `mapstructure:"token_ttl"`
+	NumUses            int      `mapstructure:"num_uses"`
+	// VersionKey keys the HMAC used for version digests.
+	VersionKey string `mapstructure:"version_key"`
+	// VersionTransitKey names a transit key used to HMAC version digests
+	// instead of VersionKey.
+	VersionTransitKey   string `mapstructure:"version_transit_key"`
+	VersionTransitMount string `mapstructure:"version_transit_mount"`
+	// Include, Exclude, IncludeKeys and ExcludeKeys are glob patterns, or
+	// regular expressions prefixed with "regex:", selecting secrets and keys.
+	Include     []string `mapstructure:"include"`
+	Exclude     []string `mapstructure:"exclude"`
+	IncludeKeys []string `mapstructure:"include_keys"`
+	ExcludeKeys []string `mapstructure:"exclude_keys"`
+	// MaxConcurrency bounds the vault requests made at once.
+	MaxConcurrency int    `mapstructure:"max_concurrency"`
+	Retry          Retry  `mapstructure:"retry"`
+	RequestTimeout string `mapstructure:"request_timeout"`
+	// Timeout bounds the vault requests of a whole step.
+	Timeout   string    `mapstructure:"timeout"`
+	RateLimit RateLimit `mapstructure:"rate_limit"`
+
+	filter      filter
+	retryPolicy retryPolicy
+}
+
+// Retry configures how vault requests failing with a network error or one of
+// StatusCodes are retried.
+type Retry struct {
+	Attempts    int      `mapstructure:"attempts"`
+	Backoff     string   `mapstructure:"backoff"`
+	MaxBackoff  string   `mapstructure:"max_backoff"`
+	Jitter      *float64 `mapstructure:"jitter"`
+	StatusCodes []int    `mapstructure:"status_codes"`
+}
+
+// Auth selects a vault auth method to log in with instead of a static token or AppRole.
+type Auth struct {
+	Method   string `mapstructure:"method"`
+	Role     string `mapstructure:"role"`
+	Mount    string `mapstructure:"mount"`
+	JWT      string `mapstructure:"jwt"`
+	JWTPath  string `mapstructure:"jwt_path"`
+	JWTEnv   string `mapstructure:"jwt_env"`
+	ServerID string `mapstructure:"server_id"`
+	Region   string `mapstructure:"region"`
 }
 type Version struct {
 	SecretSHA1 string `mapstructure:"secret_sha1"`
+	SecretHMAC string `mapstructure:"secret_hmac"`
 	URL        string `mapstructure:"url"`
+	KVVersions string `mapstructure:"kv_versions"`
+	// Paths is a JSON object mapping each secret path to a digest of its data.
+	Paths string `mapstructure:"paths"`
 }
 
 func validateField(field string, values ...string) error {
@@ -41,6 +131,28 @@ func validateField(field string, values ...string) error {
 	}
 	return nil
 }
+func parseInParams(p oc.Params) (InParams, error) {
+	var result InParams
+	err := mapstructure.Decode(p, &result)
+	if result.Format == "" {
+		result.Format = defaultFormat
+	}
+	if !knownFormat(result.Format) {
+		return InParams{}, fmt.Errorf("Unknown format `%s', expected one of %s", result.Format, strings.Join(inFormats, ", "))
+	}
+	for i, t := range result.Templates {
+		if err := t.validate(i); err != nil {
+			return InParams{}, err
+		}
+	}
+	if err := result.parseFileOptions(); err != nil {
+		return InParams{}, err
+	}
+	if err := result.parseEncryption(); err != nil {
+		return InParams{}, err
+	}
+	return result, err
+}
 func parseOutParams(p oc.Params) (OutParams, error) {
 	var result OutParams
 	err := mapstructure.Decode(p, &result)
@@ -63,40 +175,241 @@ func parseSource(s oc.Source) (Source, error) {
 	if err := validateField("url", result.URL); err != nil {
 		return Source{}, err
 	}
-	if result.RoleID != "" { // TODO: handle case when only secretid is set
+	if result.Auth.Method != "" {
+		auth, err := parseAuth(result.Auth)
+		if err != nil {
+			return Source{}, err
+		}
+		result.Auth = auth
+		if auth.Method == AuthCert && result.ClientCert == "" {
+			return Source{}, fmt.Errorf("The cert auth method requires client_cert and client_key")
+		}
+	} else if result.RoleID != "" { // TODO: handle case when only secretid is set
 		if err := validateField("role_id", result.RoleID); err != nil {
 			return Source{}, err
 		}
 		if err := validateField("secret_id", result.SecretID); err != nil {
 			return Source{}, err
 		}
+		if result.ApproleMount == "" {
+			result.ApproleMount = defaultApproleMount
+		}
 	} else {
 		if err := validateField("token", result.Token); err != nil {
 			return Source{}, err
 		}
 	}
+	if (result.ClientCert == "") != (result.ClientKey == "") {
+		return Source{}, fmt.Errorf("Both client_cert and client_key must be set for mutual TLS")
+	}
 	if err := validateField("paths", result.Paths...); err != nil {
 		return Source{}, err
 	}
+	if result.VersionTransitMount == "" {
+		result.VersionTransitMount = defaultTransitMount
+	}
+	if result.MaxConcurrency < 0 {
+		return Source{}, fmt.Errorf("max_concurrency must be positive")
+	}
+	if result.MaxConcurrency == 0 {
+		result.MaxConcurrency = defaultMaxConcurrency
+	}
+	if err := result.compileFilter(); err != nil {
+		return Source{}, err
+	}
+	if err := result.parseRetryPolicy(); err != nil {
+		return Source{}, err
+	}
+	if err := result.RateLimit.validate(); err != nil {
+		return Source{}, err
+	}
 	return result, err
 }
+func parseAuth(a Auth) (Auth, error) {
+	if a.Mount == "" {
+		a.Mount = defaultAuthMounts[a.Method]
+	}
+	switch a.Method {
+	case AuthKubernetes:
+		if a.JWTPath == "" {
+			a.JWTPath = defaultKubernetesJWTPath
+		}
+		if err := validateField("auth.role", a.Role); err != nil {
+			return Auth{}, err
+		}
+	case AuthJWT:
+		if a.JWT == "" && a.JWTPath == "" && a.JWTEnv == "" {
+			return Auth{}, fmt.Errorf("One of auth.jwt, auth.jwt_path or auth.jwt_env must be set")
+		}
+	case AuthCert:
+	case AuthAWSIAM:
+		if err := validateField("auth.role", a.Role); err != nil {
+			return Auth{}, err
+		}
+	default:
+		return Auth{}, fmt.Errorf("Unsupported auth method `%s'", a.Method)
+	}
+	return a, nil
+}
 func (version Version) toOCVersion() oc.Version {
-	return oc.Version{
-		"secret_sha1": version.SecretSHA1,
-		"url":         version.URL,
+	v := oc.Version{
+		"url": version.URL,
+	}
+	if version.Paths != "" {
+		v["paths"] = version.Paths
 	}
+	if version.SecretHMAC != "" {
+		v["secret_hmac"] = version.SecretHMAC
+	} else {
+		v["secret_sha1"] = version.SecretSHA1
+	}
+	if version.KVVersions != "" {
+		v["kv_versions"] = version.KVVersions
+	}
+	return v
 }
 func parseVersion(v oc.Version) (Version, error) {
 	var result Version
 	err := mapstructure.Decode(v, &result)
 	return result, err
 }
-func newVersion(bytesToSha1 []byte, url string) Version {
-	return Version{
-		SecretSHA1: fmt.Sprintf("%x", sha1.Sum(bytesToSha1)),
-		URL:        url,
+
+// newVersion digests secrets, a map of each path to the state check watches.
+// Besides the overall digest, the version records the KV version of each KV v2
+// secret and, when d is keyed, a short digest of each secret whose values are
+// watched, so changed paths can be told apart. Unkeyed digests of single
+// secrets are left out, as they are easily brute forced.
+func newVersion(secrets map[string]interface{}, url string, d digester) (Version, error) {
+	raw, err := json.Marshal(&secrets)
+	if err != nil {
+		return Version{}, err
+	}
+	digested := []string{}
+	kvVersions := map[string]uint{}
+	for path, state := range secrets {
+		if versioned, ok := state.(kvVersioned); ok {
+			kvVersions[path] = versioned.kvVersion()
+		}
+		if _, ok := state.(kvMetadata); !ok && d.keyed {
+			digested = append(digested, path)
+		}
+	}
+	if len(digested) > maxPathDigests {
+		digested = nil
+	}
+	if len(kvVersions) > maxPathDigests {
+		kvVersions = nil
+	}
+	sort.Strings(digested)
+	inputs := [][]byte{raw}
+	for _, path := range digested {
+		rawSecret, err := json.Marshal(secrets[path])
+		if err != nil {
+			return Version{}, err
+		}
+		inputs = append(inputs, rawSecret)
+	}
+	digests, err := d.digest(inputs)
+	if err != nil {
+		return Version{}, err
+	}
+	version := Version{URL: url}
+	if len(digested) > 0 {
+		pathDigests := make(map[string]string, len(digested))
+		for i, path := range digested {
+			pathDigests[path] = digests[i+1][:pathDigestLength]
+		}
+		rawDigests, err := json.Marshal(pathDigests)
+		if err != nil {
+			return Version{}, err
+		}
+		version.Paths = string(rawDigests)
+	}
+	if len(kvVersions) > 0 {
+		rawKVVersions, err := json.Marshal(kvVersions)
+		if err != nil {
+			return Version{}, err
+		}
+		version.KVVersions = string(rawKVVersions)
+	}
+	if d.keyed {
+		version.SecretHMAC = digests[0]
+	} else {
+		version.SecretSHA1 = digests[0]
+	}
+	return version, nil
+}
+func (version Version) pathDigests() (map[string]string, error) {
+	digests := map[string]string{}
+	if version.Paths == "" {
+		return digests, nil
 	}
+	err := json.Unmarshal([]byte(version.Paths), &digests)
+	return digests, err
+}
+
+// kvVersions returns the KV v2 version number recorded for each path.
+func (version Version) kvVersions() (map[string]uint, error) {
+	numbers := map[string]uint{}
+	if version.KVVersions == "" {
+		return numbers, nil
+	}
+	err := json.Unmarshal([]byte(version.KVVersions), &numbers)
+	return numbers, err
+}
+
+// pathStates maps each path the version tracks on its own to its digest or,
+// for KV v2 secrets without one, to its KV version.
+func (version Version) pathStates() (map[string]string, error) {
+	states, err := version.pathDigests()
+	if err != nil {
+		return nil, err
+	}
+	numbers, err := version.kvVersions()
+	if err != nil {
+		return nil, err
+	}
+	for path, number := range numbers {
+		if _, ok := states[path]; !ok {
+			states[path] = strconv.FormatUint(uint64(number), 10)
+		}
+	}
+	return states, nil
+}
+
+// changedPaths lists the paths added, removed or modified between two versions.
+// Versions that track no path on its own yield ErrNoPathDigests.
+func changedPaths(from, to Version) ([]string, error) {
+	if (from.Paths == "" && from.KVVersions == "") || (to.Paths == "" && to.KVVersions == "") {
+		return nil, ErrNoPathDigests
+	}
+	oldStates, err := from.pathStates()
+	if err != nil {
+		return nil, err
+	}
+	newStates, err := to.pathStates()
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	for path, state := range newStates {
+		if oldStates[path] != state {
+			changed = append(changed, path)
+		}
+	}
+	for path := range oldStates {
+		if _, ok := newStates[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
 }
 func (version Version) equal(v Version) bool {
-	return version.SecretSHA1 == v.SecretSHA1 && version.URL == v.URL
+	return version.SecretSHA1 == v.SecretSHA1 && version.SecretHMAC == v.SecretHMAC && version.URL == v.URL
+}
+
+// legacy reports whether the version was recorded with an unkeyed SHA1 digest.
+func (version Version) legacy() bool {
+	return version.SecretHMAC == "" && version.SecretSHA1 != ""
 }
@@ -0,0 +1,300 @@
+package resource_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Version", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	pathDigests := func(version oc.Version) map[string]string {
+		digests := map[string]string{}
+		Expect(json.Unmarshal([]byte(version["paths"]), &digests)).To(Succeed())
+		return digests
+	}
+
+	kvVersions := func(version oc.Version) map[string]uint {
+		numbers := map[string]uint{}
+		Expect(json.Unmarshal([]byte(version["kv_versions"]), &numbers)).To(Succeed())
+		return numbers
+	}
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		vault.Set("secret/app/db", map[string]string{"password": "hunter2"})
+		vault.Set("secret/app/tls", map[string]string{"certificate": "cert"})
+		source = oc.Source{
+			"url":   vault.URL,
+			"token": vault.Token,
+			"paths": []string{"secret/app"},
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should carry a digest per path when keyed", func() {
+		source["version_key"] = "pipeline-key"
+		versions, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions).To(HaveLen(1))
+		digests := pathDigests(versions[0])
+		Expect(digests).To(HaveLen(2))
+		Expect(digests).To(HaveKey("secret/app/db"))
+		Expect(digests).To(HaveKey("secret/app/tls"))
+	})
+
+	It("should not carry unkeyed digests of single secrets", func() {
+		versions, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions[0]).To(HaveKey("secret_sha1"))
+		Expect(versions[0]).ToNot(HaveKey("paths"))
+	})
+
+	It("should only carry the overall digest for large trees", func() {
+		source["version_key"] = "pipeline-key"
+		for i := 0; i < 200; i++ {
+			vault.Set(fmt.Sprintf("secret/app/many/%d", i), map[string]string{"n": "n"})
+		}
+		versions, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions[0]).To(HaveKey("secret_hmac"))
+		Expect(versions[0]).ToNot(HaveKey("paths"))
+	})
+
+	It("should only change the digests of paths that changed", func() {
+		source["version_key"] = "pipeline-key"
+		versions, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		before := pathDigests(versions[0])
+
+		vault.Set("secret/app/db", map[string]string{"password": "correct horse"})
+		versions, err = r.Check(source, versions[0], env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		after := pathDigests(versions[0])
+
+		Expect(after["secret/app/db"]).ToNot(Equal(before["secret/app/db"]))
+		Expect(after["secret/app/tls"]).To(Equal(before["secret/app/tls"]))
+	})
+
+	Describe("keyed digests", func() {
+		It("should record an HMAC instead of a SHA1 when version_key is set", func() {
+			source["version_key"] = "pipeline-key"
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions[0]).To(HaveKey("secret_hmac"))
+			Expect(versions[0]).ToNot(HaveKey("secret_sha1"))
+			Expect(versions[0]["secret_hmac"]).To(HaveLen(64))
+		})
+
+		It("should produce different digests for different keys", func() {
+			source["version_key"] = "one"
+			one, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			source["version_key"] = "two"
+			two, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(one[0]["secret_hmac"]).ToNot(Equal(two[0]["secret_hmac"]))
+		})
+
+		It("should not retrigger a legacy version when a key is added", func() {
+			legacy, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(legacy[0]).To(HaveKey("secret_sha1"))
+
+			source["version_key"] = "pipeline-key"
+			versions, err := r.Check(source, legacy[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(Equal([]oc.Version{legacy[0]}))
+
+			vault.Set("secret/app/db", map[string]string{"password": "correct horse"})
+			versions, err = r.Check(source, legacy[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions[0]).To(HaveKey("secret_hmac"))
+		})
+
+		It("should compute the HMAC with a transit key", func() {
+			var inputs int
+			vault.Handle("transit/hmac/versions/sha2-256", func(w http.ResponseWriter, req *http.Request) {
+				var body struct {
+					BatchInput []map[string]string `json:"batch_input"`
+				}
+				json.NewDecoder(req.Body).Decode(&body)
+				inputs = len(body.BatchInput)
+				results := []map[string]string{}
+				for _, input := range body.BatchInput {
+					raw, _ := base64.StdEncoding.DecodeString(input["input"])
+					sum := sha256.Sum256(append([]byte("transit"), raw...))
+					results = append(results, map[string]string{
+						"hmac": "vault:v1:" + base64.StdEncoding.EncodeToString(sum[:]),
+					})
+				}
+				writeFakeJSON(w, map[string]interface{}{
+					"data": map[string]interface{}{"batch_results": results},
+				})
+			})
+			source["version_transit_key"] = "versions"
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inputs).To(Equal(3))
+			Expect(versions[0]["secret_hmac"]).To(HaveLen(64))
+			Expect(pathDigests(versions[0])).To(HaveLen(2))
+		})
+	})
+
+	Describe("on a KV v2 mount", func() {
+		BeforeEach(func() {
+			vault.Mount("kv", 2)
+			vault.Set("kv/app/db", map[string]string{"password": "hunter2"})
+			vault.Set("kv/app/tls", map[string]string{"certificate": "cert"})
+			source["paths"] = []string{"kv/app"}
+		})
+
+		It("should check metadata without reading secret values", func() {
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kvVersions(versions[0])).To(HaveLen(2))
+			Expect(versions[0]).ToNot(HaveKey("paths"))
+			for _, request := range vault.Requests() {
+				Expect(request).ToNot(HavePrefix("GET kv/data/"))
+			}
+		})
+
+		It("should leave out KV versions for large trees", func() {
+			for i := 0; i < 200; i++ {
+				vault.Set(fmt.Sprintf("kv/app/many/%d", i), map[string]string{"n": "n"})
+			}
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions[0]).To(HaveKey("secret_sha1"))
+			Expect(versions[0]).ToNot(HaveKey("kv_versions"))
+		})
+
+		It("should notice a new KV version", func() {
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			before := kvVersions(versions[0])
+
+			unchanged, err := r.Check(source, versions[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unchanged).To(Equal([]oc.Version{versions[0]}))
+
+			vault.Set("kv/app/db", map[string]string{"password": "hunter2"})
+			versions, err = r.Check(source, versions[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			after := kvVersions(versions[0])
+			Expect(after["kv/app/db"]).ToNot(Equal(before["kv/app/db"]))
+			Expect(after["kv/app/tls"]).To(Equal(before["kv/app/tls"]))
+		})
+
+		Describe("upgrading from versions digested over values", func() {
+			var legacy oc.Version
+
+			BeforeEach(func() {
+				raw, err := json.Marshal(map[string]map[string]string{
+					"kv/app/db":  {"password": "hunter2"},
+					"kv/app/tls": {"certificate": "cert"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				legacy = oc.Version{"url": vault.URL, "secret_sha1": fmt.Sprintf("%x", sha1.Sum(raw))}
+			})
+
+			It("should keep the legacy version until the secrets change", func() {
+				versions, err := r.Check(source, legacy, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]oc.Version{legacy}))
+
+				vault.Set("kv/app/db", map[string]string{"password": "correct horse"})
+				versions, err = r.Check(source, legacy, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(HaveLen(1))
+				Expect(versions[0]).To(HaveKey("kv_versions"))
+			})
+
+			It("should keep the legacy version when a key is added", func() {
+				source["version_key"] = "pipeline-key"
+				versions, err := r.Check(source, legacy, env, testLogger)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]oc.Version{legacy}))
+			})
+		})
+
+		It("should leave out secrets whose current version is destroyed", func() {
+			vault.Destroy("kv/app/db", 1)
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			numbers := kvVersions(versions[0])
+			Expect(numbers).To(HaveLen(1))
+			Expect(numbers).To(HaveKey("kv/app/tls"))
+		})
+	})
+
+	Describe("KV v2 version history", func() {
+		kvVersion := func(version oc.Version) uint {
+			numbers := map[string]uint{}
+			Expect(json.Unmarshal([]byte(version["kv_versions"]), &numbers)).To(Succeed())
+			Expect(numbers).To(HaveLen(1))
+			return numbers["kv/app/db"]
+		}
+
+		BeforeEach(func() {
+			vault.Mount("kv", 2)
+			vault.Set("kv/app/db", map[string]string{"password": "one"})
+			source["paths"] = []string{"kv/app/db"}
+		})
+
+		It("should only return the current version on the first check", func() {
+			vault.Set("kv/app/db", map[string]string{"password": "two"})
+			versions, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(HaveLen(1))
+			Expect(kvVersion(versions[0])).To(Equal(uint(2)))
+		})
+
+		It("should return every KV version since the last one seen", func() {
+			first, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+
+			vault.Set("kv/app/db", map[string]string{"password": "two"})
+			vault.Set("kv/app/db", map[string]string{"password": "three"})
+			vault.Set("kv/app/db", map[string]string{"password": "four"})
+			vault.Destroy("kv/app/db", 3)
+			versions, err := r.Check(source, first[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(HaveLen(2))
+			Expect(kvVersion(versions[0])).To(Equal(uint(2)))
+			Expect(kvVersion(versions[1])).To(Equal(uint(4)))
+			Expect(versions[0]["secret_sha1"]).ToNot(Equal(versions[1]["secret_sha1"]))
+		})
+
+		It("should only return the current version for several paths", func() {
+			vault.Set("kv/app/tls", map[string]string{"certificate": "cert"})
+			source["paths"] = []string{"kv/app"}
+			first, err := r.Check(source, nil, env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+
+			vault.Set("kv/app/db", map[string]string{"password": "two"})
+			vault.Set("kv/app/db", map[string]string{"password": "three"})
+			versions, err := r.Check(source, first[0], env, testLogger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(HaveLen(1))
+		})
+	})
+})
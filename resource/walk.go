@@ -0,0 +1,230 @@
+// Package resource is an implementation of a Concourse resource.
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-community/vaultkv"
+	sv "github.com/starkandwayne/safe/vault"
+)
+
+// defaultMaxConcurrency bounds how many vault requests a step makes at once
+// when max_concurrency is not set.
+const defaultMaxConcurrency = 8
+
+// limit runs fn, which makes a vault request, once fewer than max_concurrency
+// other requests are in flight.
+func (r *Resource) limit(fn func() error) error {
+	r.requests <- struct{}{}
+	defer func() { <-r.requests }()
+	return fn()
+}
+
+// forEach calls fn for each index from a pool of max_concurrency workers fed
+// from a queue, and waits for them all. An fn that calls forEach itself, as
+// reading each path of a source does, starts a pool per worker, so a step may
+// run up to max_concurrency² goroutines; only the vault requests in flight
+// are bounded by limit. The error of the lowest failing index is returned, so
+// failures are reported consistently.
+func (r *Resource) forEach(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	workers := cap(r.requests)
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listSecrets returns the sorted paths of the secrets at and below p, or only
+// p itself when it selects keys.
+func (r *Resource) listSecrets(p secretPath, mountVersion uint) ([]string, error) {
+	exists, err := r.secretExists(p.path, mountVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.keys) > 0 {
+		if !exists {
+			return nil, fmt.Errorf("`%s' is not a secret", p.path)
+		}
+		return []string{p.path}, nil
+	}
+	paths, err := r.listTree(p.path)
+	if sv.IsNotFound(err) && exists {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		paths = append(paths, p.path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (r *Resource) secretExists(path string, mountVersion uint) (bool, error) {
+	var err error
+	if mountVersion == 2 {
+		_, err = r.getMetadata(path)
+	} else {
+		err = r.limit(func() error {
+			_, err := r.client.Read(path)
+			return err
+		})
+	}
+	if sv.IsNotFound(err) || vaultkv.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error reading `%s': %s", path, err)
+	}
+	return true, nil
+}
+
+// listTree lists the secrets below dir one level at a time, listing the
+// subdirectories of each level concurrently. Like safe, it skips
+// subdirectories the token may not list.
+func (r *Resource) listTree(dir string) ([]string, error) {
+	var paths []string
+	dirs := []string{dir}
+	for depth := 0; len(dirs) > 0; depth++ {
+		found := make([][]string, len(dirs))
+		subdirs := make([][]string, len(dirs))
+		err := r.forEach(len(dirs), func(i int) error {
+			var entries []string
+			err := r.limit(func() (err error) {
+				entries, err = r.client.List(dirs[i])
+				return err
+			})
+			if sv.IsNotFound(err) || vaultkv.IsForbidden(err) {
+				if depth == 0 {
+					return err
+				}
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Error listing `%s': %s", dirs[i], err)
+			}
+			for _, entry := range entries {
+				if entry == "" {
+					continue
+				}
+				path := strings.TrimSuffix(dirs[i], "/") + "/" + strings.TrimSuffix(entry, "/")
+				if strings.HasSuffix(entry, "/") {
+					subdirs[i] = append(subdirs[i], path)
+				} else {
+					found[i] = append(found[i], path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		dirs = nil
+		for i := range found {
+			paths = append(paths, found[i]...)
+			dirs = append(dirs, subdirs[i]...)
+		}
+	}
+	return paths, nil
+}
+
+// readSecrets reads the current value of each secret concurrently, skipping
+// secrets that are gone or whose latest KV version is deleted, and secrets
+// the token may not read.
+func (r *Resource) readSecrets(paths []string) (sv.Secrets, error) {
+	entries := make([]*sv.SecretEntry, len(paths))
+	err := r.forEach(len(paths), func(i int) error {
+		raw := map[string]interface{}{}
+		var meta vaultkv.KVVersion
+		err := r.limit(func() (err error) {
+			meta, err = r.client.Client().Get(paths[i], &raw, nil)
+			return err
+		})
+		if vaultkv.IsNotFound(err) || vaultkv.IsForbidden(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading `%s': %s", paths[i], err)
+		}
+		secret, err := newSecret(raw)
+		if err != nil {
+			return err
+		}
+		entries[i] = &sv.SecretEntry{
+			Path:     paths[i],
+			Versions: []sv.SecretVersion{{Data: secret, Number: meta.Version}},
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	secrets := sv.Secrets{}
+	for _, e := range entries {
+		if e != nil {
+			secrets.Append(*e)
+		}
+	}
+	return secrets, nil
+}
+
+// newSecret converts a raw vault response the way safe does, encoding
+// non-string values as JSON.
+func newSecret(raw map[string]interface{}) (*sv.Secret, error) {
+	secret := sv.NewSecret()
+	for key, value := range raw {
+		s, ok := value.(string)
+		if !ok {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			s = string(b)
+		}
+		secret.Set(key, s, false)
+	}
+	return secret, nil
+}
+
+func (r *Resource) getMetadata(path string) (meta vaultkv.V2Metadata, err error) {
+	kv := r.client.Client()
+	mount, err := kv.MountPath(path)
+	if err != nil {
+		return meta, err
+	}
+	err = r.limit(func() (err error) {
+		meta, err = kv.Client.V2GetMetadata(mount, strings.TrimPrefix(path, mount))
+		return err
+	})
+	return meta, err
+}
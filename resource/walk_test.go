@@ -0,0 +1,103 @@
+package resource_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/vault-concourse-resource/resource"
+)
+
+var _ = Describe("Concurrency", func() {
+	var (
+		vault      *fakeVault
+		source     oc.Source
+		r          = &resource.Resource{}
+		env        = oc.NewEnvironment()
+		testLogger = oc.NewLogger(oc.SilentLevel)
+	)
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+		vault.Mount("kv", 2)
+		for i := 0; i < 10; i++ {
+			vault.Set(fmt.Sprintf("secret/tree/%d/a", i), map[string]string{"n": fmt.Sprint(i)})
+			vault.Set(fmt.Sprintf("kv/tree/%d/a", i), map[string]string{"n": fmt.Sprint(i)})
+		}
+		vault.Delay = 10 * time.Millisecond
+		source = oc.Source{
+			"url":             vault.URL,
+			"token":           vault.Token,
+			"paths":           []string{"secret/tree", "kv/tree"},
+			"max_concurrency": 4,
+		}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("should make at most max_concurrency requests at once", func() {
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vault.MaxInFlight()).To(Equal(4))
+
+		outDir, err := ioutil.TempDir("", "vault-concourse-in")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(outDir)
+		_, _, err = r.In(outDir, source, oc.Params{}, oc.Version{}, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vault.MaxInFlight()).To(Equal(4))
+	})
+
+	It("should produce the same version regardless of concurrency", func() {
+		concurrent, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		source["max_concurrency"] = 1
+		serial, err := r.Check(source, nil, env, testLogger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(concurrent).To(Equal(serial))
+	})
+
+	It("should walk wide trees with a bounded number of workers", func() {
+		for i := 0; i < 300; i++ {
+			vault.Set(fmt.Sprintf("secret/wide/%d", i), map[string]string{"n": fmt.Sprint(i)})
+		}
+		source["paths"] = []string{"secret/wide"}
+		source["max_concurrency"] = 2
+		vault.Delay = time.Millisecond
+		before := runtime.NumGoroutine()
+		peak := 0
+		done := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			for {
+				if n := runtime.NumGoroutine(); n > peak {
+					peak = n
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}()
+		_, err := r.Check(source, nil, env, testLogger)
+		close(done)
+		<-sampled
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peak - before).To(BeNumerically("<", 50))
+	})
+
+	It("should reject a negative max_concurrency", func() {
+		source["max_concurrency"] = -1
+		_, err := r.Check(source, nil, env, testLogger)
+		Expect(err).To(MatchError(ContainSubstring("max_concurrency")))
+	})
+})